@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"ren.local/gocast/pkg/models"
+	"ren.local/gocast/pkg/server"
+)
+
+// openLibrary creates a server for offline use and loads the saved index,
+// so files that have not changed are not probed again
+func openLibrary(config *server.Config) *server.VideoServer {
+	s := server.New(config)
+	if err := s.LoadIndex(); err != nil && !os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+	}
+	return s
+}
+
+func scan(args []string) int {
+	fs := flag.NewFlagSet("scan", flag.ExitOnError)
+	config := configFlags(fs)
+	fs.Parse(args)
+
+	videos, errs := openLibrary(config).Scan()
+	for _, video := range videos {
+		fmt.Printf("%s  %-9s  %-9s  %s\n", video.VideoID, formatDuration(video.Media), formatResolution(video.Media), video.Name)
+	}
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+	}
+	fmt.Printf("%d videos, %d errors\n", len(videos), len(errs))
+
+	if len(errs) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func thumbs(args []string) int {
+	fs := flag.NewFlagSet("thumbs", flag.ExitOnError)
+	config := configFlags(fs)
+	regenerate := fs.Bool("regenerate", false, "rebuild every thumbnail, not only missing or outdated ones")
+	fs.Parse(args)
+
+	s := openLibrary(config)
+	videos, errs := s.Scan()
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+	}
+
+	generated, failed := 0, 0
+	s.GenerateThumbnails(videos, *regenerate, func(video models.VideoFile, err error) {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s: %v\n", video.Name, err)
+			failed++
+			return
+		}
+		fmt.Printf("%s  %s\n", video.VideoID, video.Name)
+		generated++
+	})
+	fmt.Printf("%d generated, %d failed\n", generated, failed)
+
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func probe(args []string) int {
+	fs := flag.NewFlagSet("probe", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprintln(os.Stderr, "Usage: gocast probe <file>...") }
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	status := 0
+	for _, path := range fs.Args() {
+		media, err := server.ProbeFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s: %v\n", path, err)
+			status = 1
+			continue
+		}
+		data, _ := json.MarshalIndent(media, "", "  ")
+		if fs.NArg() > 1 {
+			fmt.Printf("%s:\n", path)
+		}
+		fmt.Println(string(data))
+	}
+	return status
+}
+
+func stats(args []string) int {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	url := fs.String("url", "http://localhost:4221", "address of the running server, including any base path")
+	fs.Parse(args)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(strings.TrimSuffix(*url, "/") + "/admin/stats")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	if resp.StatusCode != 200 {
+		fmt.Fprintf(os.Stderr, "error: %s: %s\n", resp.Status, bytes.TrimSpace(body))
+		return 1
+	}
+
+	var out bytes.Buffer
+	if err := json.Indent(&out, body, "", "  "); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	fmt.Println(out.String())
+	return 0
+}
+
+func verify(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	config := configFlags(fs)
+	deep := fs.Bool("deep", false, "decode every file completely (slow)")
+	fs.Parse(args)
+
+	s := openLibrary(config)
+	videos, errs := s.Scan()
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+	}
+
+	bad := 0
+	for _, video := range videos {
+		if err := s.Verify(video, *deep); err != nil {
+			fmt.Printf("BAD  %s  %s: %v\n", video.VideoID, video.Name, err)
+			bad++
+		}
+	}
+	fmt.Printf("%d videos checked, %d bad\n", len(videos), bad)
+
+	if bad > 0 || len(errs) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// formatDuration renders a probed duration as h:mm:ss, or "-" if unknown
+func formatDuration(media *models.MediaInfo) string {
+	if media == nil || media.Duration <= 0 {
+		return "-"
+	}
+	d := time.Duration(media.Duration) * time.Second
+	return fmt.Sprintf("%d:%02d:%02d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60)
+}
+
+// formatResolution renders a probed frame size, or "-" if unknown
+func formatResolution(media *models.MediaInfo) string {
+	if media == nil || media.Width == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%dx%d", media.Width, media.Height)
+}
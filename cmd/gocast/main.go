@@ -1,16 +1,99 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
+	"fmt"
 	"log"
+	"log/slog"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"ren.local/gocast/pkg/server"
 )
 
+const usage = `Usage: gocast <command> [flags]
+
+Commands:
+  serve    Start the server (the default with no command)
+  scan     Index the video library and report files that fail to probe
+  thumbs   Generate missing or outdated thumbnails, or all with -regenerate
+  probe    Print the streams ffprobe finds in a file
+  stats    Print the metrics of a running server
+  verify   Find unreadable or corrupt videos
+
+Run "gocast <command> -h" for the flags of a command.
+`
+
 func main() {
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+
+	command, args := "serve", flag.Args()
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+
+	commands := map[string]func([]string) int{
+		"serve":  serve,
+		"scan":   scan,
+		"thumbs": thumbs,
+		"probe":  probe,
+		"stats":  stats,
+		"verify": verify,
+	}
+	if command == "help" {
+		flag.Usage()
+		return
+	}
+	run, ok := commands[command]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "gocast: unknown command %q\n\n", command)
+		flag.Usage()
+		os.Exit(2)
+	}
+	os.Exit(run(args))
+}
+
+// configFlags registers the flags shared by commands that work on the
+// library and returns the config they fill in
+func configFlags(fs *flag.FlagSet) *server.Config {
 	config := server.DefaultConfig()
+	fs.StringVar(&config.VideoDir, "videos", config.VideoDir, "video library directory")
+	fs.StringVar(&config.ThumbnailDir, "thumbnails", config.ThumbnailDir, "thumbnail cache directory")
+	fs.StringVar(&config.IndexPath, "index", config.IndexPath, "saved index file, empty to disable")
+	return config
+}
+
+func serve(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	config := configFlags(fs)
+	fs.StringVar(&config.Port, "addr", config.Port, "address to listen on")
+	fs.Func("listen", "`[routes@]address` to listen on, repeatable; overrides -addr (see Readme)", func(spec string) error {
+		listener, err := server.ParseListener(spec)
+		if err != nil {
+			return err
+		}
+		config.Listeners = append(config.Listeners, listener)
+		return nil
+	})
+	fs.StringVar(&config.BasePath, "base-path", config.BasePath, "URL prefix when served under a sub-path, e.g. /media")
+	fs.Func("trusted-proxies", "comma-separated `CIDRs` whose forwarding headers are believed", func(list string) error {
+		config.TrustedProxies = strings.Split(list, ",")
+		return nil
+	})
+	fs.StringVar(&config.TemplateDir, "templates", config.TemplateDir, "directory of custom page templates")
+	fs.BoolVar(&config.TemplateReload, "template-reload", config.TemplateReload, "re-read -templates when its files change")
+	fs.StringVar(&config.LogLevel, "log-level", config.LogLevel, "debug, info, warn or error")
+	fs.BoolVar(&config.ZeroCopy, "zero-copy", config.ZeroCopy, "send uncached ranges with sendfile")
+	fs.DurationVar(&config.DrainTimeout, "drain-timeout", config.DrainTimeout, "how long requests in progress may finish on shutdown")
+	fs.Func("limits", "bandwidth `JSON` as accepted by /admin/limits, e.g. {\"global\": 50000000}", func(limits string) error {
+		// Fields left out keep their defaults, as with /admin/limits
+		return json.Unmarshal([]byte(limits), &config.Limits)
+	})
+	fs.Parse(args)
 
 	// Check if directory exists first
 	if _, err := os.Stat(config.VideoDir); os.IsNotExist(err) {
@@ -22,20 +105,41 @@ func main() {
 
 	// Initialize and start the server
 	server := server.New(config)
+	// Route the remaining log.Printf calls through the JSON logger too
+	slog.SetDefault(server.Logger)
 	if err := server.Start(); err != nil {
 		log.Fatal(err)
 	}
 
-	log.Printf("Server running on %s\n", config.Port)
 	log.Printf("Place video files in the '%s' directory\n", config.VideoDir)
 
-	// Wait for interrupt signal
+	// Wait for interrupt signal, or SIGUSR2 to hand over to a new binary
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	<-c
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGUSR2)
+	for sig := range c {
+		if sig != syscall.SIGUSR2 {
+			log.Println("Shutting down server...")
+			break
+		}
+		log.Println("Upgrading...")
+		if err := server.Upgrade(); err != nil {
+			log.Printf("Upgrade failed, still serving: %v", err)
+			continue
+		}
+		log.Println("New process is serving, draining this one...")
+		break
+	}
 
-	// Graceful shutdown
-	log.Println("Shutting down server...")
+	// Graceful shutdown; a second signal skips the drain
+	go func() {
+		for sig := range c {
+			if sig != syscall.SIGUSR2 {
+				log.Println("Forced shutdown")
+				os.Exit(1)
+			}
+		}
+	}()
 	server.Stop()
 	log.Println("Server stopped")
+	return 0
 }
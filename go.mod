@@ -2,4 +2,8 @@ module ren.local/gocast
 
 go 1.22.6
 
-require golang.org/x/time v0.8.0
+require (
+	github.com/andybalholm/brotli v1.2.6
+	github.com/klauspost/compress v1.17.11
+	golang.org/x/time v0.8.0
+)
@@ -0,0 +1,166 @@
+package models
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// BlockKey identifies a fixed-size block of a file. The modification time
+// and size are part of the key so edited files never serve stale blocks.
+type BlockKey struct {
+	Path    string
+	ModTime int64
+	Size    int64
+	Index   int64
+}
+
+type cacheEntry struct {
+	key        BlockKey
+	data       []byte
+	lastAccess time.Time
+}
+
+// blockLoad lets concurrent misses for the same block share one read
+type blockLoad struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// BlockCache is an LRU cache of file blocks shared by all connections,
+// bounded by a global memory limit
+type BlockCache struct {
+	mu      sync.Mutex
+	limit   int64
+	size    int64
+	lru     *list.List
+	entries map[BlockKey]*list.Element
+	loading map[BlockKey]*blockLoad
+	metrics *Metrics
+}
+
+// NewBlockCache creates a cache that holds at most limit bytes
+func NewBlockCache(limit int64, metrics *Metrics) *BlockCache {
+	return &BlockCache{
+		limit:   limit,
+		lru:     list.New(),
+		entries: make(map[BlockKey]*list.Element),
+		loading: make(map[BlockKey]*blockLoad),
+		metrics: metrics,
+	}
+}
+
+// Get returns a cached block and marks it recently used
+func (c *BlockCache) Get(key BlockKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	entry.lastAccess = time.Now()
+	c.lru.MoveToFront(elem)
+	return entry.data, true
+}
+
+// Load returns the block for key, calling read to fill it on a miss. Only
+// one read runs per key at a time; other callers wait for its result.
+func (c *BlockCache) Load(key BlockKey, read func() ([]byte, error)) ([]byte, error) {
+	if data, ok := c.Get(key); ok {
+		return data, nil
+	}
+
+	c.mu.Lock()
+	if load, ok := c.loading[key]; ok {
+		c.mu.Unlock()
+		<-load.done
+		return load.data, load.err
+	}
+	load := &blockLoad{done: make(chan struct{})}
+	c.loading[key] = load
+	c.mu.Unlock()
+
+	load.data, load.err = read()
+
+	c.mu.Lock()
+	delete(c.loading, key)
+	if load.err == nil {
+		c.put(key, load.data)
+	}
+	c.mu.Unlock()
+	close(load.done)
+
+	return load.data, load.err
+}
+
+// Contains reports whether a block is cached without touching its recency
+func (c *BlockCache) Contains(key BlockKey) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.entries[key]
+	return ok
+}
+
+func (c *BlockCache) put(key BlockKey, data []byte) {
+	if int64(len(data)) > c.limit {
+		return
+	}
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*cacheEntry).lastAccess = time.Now()
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, data: data, lastAccess: time.Now()})
+	c.size += int64(len(data))
+
+	for c.size > c.limit {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+func (c *BlockCache) removeElement(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	c.lru.Remove(elem)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.data))
+	if c.metrics != nil {
+		c.metrics.RecordCacheEviction()
+	}
+}
+
+// EvictIdle drops blocks not accessed within maxIdle and returns how many
+// were removed
+func (c *BlockCache) EvictIdle(maxIdle time.Duration) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	evicted := 0
+	cutoff := time.Now().Add(-maxIdle)
+	for elem := c.lru.Back(); elem != nil; {
+		prev := elem.Prev()
+		if elem.Value.(*cacheEntry).lastAccess.Before(cutoff) {
+			c.removeElement(elem)
+			evicted++
+		} else {
+			// The list is in recency order, so everything newer is in use
+			break
+		}
+		elem = prev
+	}
+	return evicted
+}
+
+// Stats returns the cache's current occupancy
+func (c *BlockCache) Stats() map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return map[string]int64{
+		"cacheBytes":  c.size,
+		"cacheLimit":  c.limit,
+		"cacheBlocks": int64(c.lru.Len()),
+	}
+}
@@ -0,0 +1,166 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// block returns size bytes identifying index, for checking what came back
+func block(index int64, size int) []byte {
+	return bytes.Repeat([]byte{byte(index)}, size)
+}
+
+func load(t *testing.T, c *BlockCache, index int64, size int) []byte {
+	t.Helper()
+	data, err := c.Load(BlockKey{Path: "f", Index: index}, func() ([]byte, error) {
+		return block(index, size), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func cached(c *BlockCache, index int64) bool {
+	return c.Contains(BlockKey{Path: "f", Index: index})
+}
+
+func TestBlockCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	metrics := NewMetrics()
+	c := NewBlockCache(300, metrics)
+	for i := int64(0); i < 3; i++ {
+		load(t, c, i, 100)
+	}
+	// Block 0 is now the most recently used, leaving 1 as the oldest
+	if _, ok := c.Get(BlockKey{Path: "f", Index: 0}); !ok {
+		t.Fatal("block 0 missing before the limit was reached")
+	}
+	load(t, c, 3, 100)
+
+	for i, want := range []bool{true, false, true, true} {
+		if cached(c, int64(i)) != want {
+			t.Errorf("block %d cached = %v, want %v", i, !want, want)
+		}
+	}
+	if stats := c.Stats(); stats["cacheBytes"] != 300 || stats["cacheBlocks"] != 3 {
+		t.Errorf("stats %v, want 300 bytes in 3 blocks", stats)
+	}
+	if metrics.GetStats()["cacheEvictions"] != 1 {
+		t.Errorf("evictions %d, want 1", metrics.GetStats()["cacheEvictions"])
+	}
+
+	// A block larger than the whole cache is returned but not kept
+	if data := load(t, c, 9, 400); len(data) != 400 || cached(c, 9) {
+		t.Error("oversized block should be returned uncached")
+	}
+	if c.Stats()["cacheBytes"] != 300 {
+		t.Error("oversized block displaced cached ones")
+	}
+}
+
+func TestBlockCacheSharesConcurrentLoads(t *testing.T) {
+	c := NewBlockCache(1<<20, nil)
+	var reads atomic.Int32
+	release := make(chan struct{})
+
+	const readers = 50
+	var wg sync.WaitGroup
+	results := make([][]byte, readers)
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data, err := c.Load(BlockKey{Path: "f", Index: 7}, func() ([]byte, error) {
+				reads.Add(1)
+				<-release // Hold the read until every reader is waiting on it
+				return block(7, 1000), nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+			results[i] = data
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := reads.Load(); n != 1 {
+		t.Errorf("block read %d times, want once", n)
+	}
+	for i, data := range results {
+		if !bytes.Equal(data, block(7, 1000)) {
+			t.Fatalf("reader %d got the wrong data", i)
+		}
+	}
+}
+
+func TestBlockCacheFailedLoadIsNotCached(t *testing.T) {
+	c := NewBlockCache(1<<20, nil)
+	key := BlockKey{Path: "f", Index: 1}
+	if _, err := c.Load(key, func() ([]byte, error) { return nil, fmt.Errorf("disk error") }); err == nil {
+		t.Fatal("want the read error")
+	}
+	if c.Contains(key) {
+		t.Fatal("failed read was cached")
+	}
+	if data := load(t, c, 1, 10); !bytes.Equal(data, block(1, 10)) {
+		t.Fatal("retry after a failed read returned the wrong data")
+	}
+}
+
+func TestBlockCacheEvictIdle(t *testing.T) {
+	c := NewBlockCache(1<<20, nil)
+	for i := int64(0); i < 4; i++ {
+		load(t, c, i, 10)
+	}
+	time.Sleep(30 * time.Millisecond)
+	c.Get(BlockKey{Path: "f", Index: 2})
+
+	if n := c.EvictIdle(20 * time.Millisecond); n != 3 {
+		t.Errorf("evicted %d idle blocks, want 3", n)
+	}
+	if !cached(c, 2) || c.Stats()["cacheBlocks"] != 1 {
+		t.Errorf("only the recently read block should remain, stats %v", c.Stats())
+	}
+}
+
+// TestBlockCacheConcurrentUse mixes loads, reads and idle eviction on a
+// cache far smaller than the working set; run it with -race
+func TestBlockCacheConcurrentUse(t *testing.T) {
+	const blockSize, limit = 100, 1000
+	c := NewBlockCache(limit, NewMetrics())
+
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for i := 0; i < 500; i++ {
+				index := r.Int63n(40)
+				data, err := c.Load(BlockKey{Path: "f", Index: index}, func() ([]byte, error) {
+					return block(index, blockSize), nil
+				})
+				if err != nil || !bytes.Equal(data, block(index, blockSize)) {
+					t.Errorf("block %d: wrong data or %v", index, err)
+					return
+				}
+				if i%50 == 0 {
+					c.EvictIdle(time.Millisecond)
+				}
+			}
+		}(int64(g))
+	}
+	wg.Wait()
+
+	stats := c.Stats()
+	if stats["cacheBytes"] > limit || stats["cacheBytes"] != stats["cacheBlocks"]*blockSize {
+		t.Errorf("inconsistent cache after concurrent use: %v", stats)
+	}
+}
@@ -1,7 +1,8 @@
 package models
 
 import (
-	"sync/atomic"
+	"sync"
+	"time"
 )
 
 // NewMetrics creates a new Metrics instance
@@ -44,43 +45,132 @@ func (m *Metrics) IncrementErrors() {
 	m.Errors++
 }
 
-// RecordPrefetchHit records a successful prefetch hit
-func (m *Metrics) RecordPrefetchHit() {
+// RecordCacheHit records a block served from the shared cache
+func (m *Metrics) RecordCacheHit() {
 	m.Mu.Lock()
 	defer m.Mu.Unlock()
-	m.PrefetchHits++
+	m.CacheHits++
 }
 
-// RecordPrefetchMiss records a prefetch miss
-func (m *Metrics) RecordPrefetchMiss() {
+// RecordCacheMiss records a block that had to be read from disk
+func (m *Metrics) RecordCacheMiss() {
 	m.Mu.Lock()
 	defer m.Mu.Unlock()
-	m.PrefetchMisses++
+	m.CacheMisses++
+}
+
+// RecordCacheEviction records a block dropped from the shared cache
+func (m *Metrics) RecordCacheEviction() {
+	m.Mu.Lock()
+	defer m.Mu.Unlock()
+	m.CacheEvictions++
+}
+
+// RecordJanitorPass records what a buffer janitor sweep removed
+func (m *Metrics) RecordJanitorPass(idleBlocks, staleConnections int) {
+	m.Mu.Lock()
+	defer m.Mu.Unlock()
+	m.IdleEvictions += int64(idleBlocks)
+	m.StaleConnections += int64(staleConnections)
+}
+
+// RecordRejectedConnection records a connection refused by the per-IP guard
+func (m *Metrics) RecordRejectedConnection() {
+	m.Mu.Lock()
+	defer m.Mu.Unlock()
+	m.RejectedConns++
+}
+
+// RecordRejectedRequest records a request refused for its rate or headers
+func (m *Metrics) RecordRejectedRequest() {
+	m.Mu.Lock()
+	defer m.Mu.Unlock()
+	m.RejectedRequests++
+}
+
+// RecordBan records a client being temporarily banned
+func (m *Metrics) RecordBan() {
+	m.Mu.Lock()
+	defer m.Mu.Unlock()
+	m.Bans++
 }
 
 // GetStats returns the current metrics
 func (m *Metrics) GetStats() map[string]int64 {
 	m.Mu.RLock()
 	defer m.Mu.RUnlock()
-	return map[string]int64{
+	stats := map[string]int64{
 		"activeConnections": m.ActiveConnections,
 		"bytesTransferred":  m.BytesTransferred,
 		"requestCount":      m.RequestCount,
 		"errors":            m.Errors,
-		"prefetchHits":      m.PrefetchHits,
-		"prefetchMisses":    m.PrefetchMisses,
+		"cacheHits":         m.CacheHits,
+		"cacheMisses":       m.CacheMisses,
+		"cacheEvictions":    m.CacheEvictions,
+		"idleEvictions":     m.IdleEvictions,
+		"staleConnections":  m.StaleConnections,
+		"rejectedConns":     m.RejectedConns,
+		"rejectedRequests":  m.RejectedRequests,
+		"bans":              m.Bans,
+	}
+	for name, value := range m.Streaming.Stats() {
+		stats[name] = value
 	}
+	return stats
 }
 
+// StreamingMetrics tracks how well video streams keep up with their clients
 type StreamingMetrics struct {
 	BytesServed        int64
 	ChunksServed       int64
-	AveragePrefetchGap float64
-	BufferUnderruns    int64
+	AveragePrefetchGap float64 // Bytes already read into the cache ahead of each chunk
+	BufferUnderruns    int64   // Writes that nearly hit the write deadline
+	FirstBytes         int64   // Streams that have sent their first byte
+	TotalTTFB          time.Duration
+	MaxTTFB            time.Duration
+	mu                 sync.Mutex
 }
 
+// RecordChunk records a chunk written to a client, with how many bytes
+// were cached ahead of it
 func (m *StreamingMetrics) RecordChunk(size int64, gap float64) {
-	atomic.AddInt64(&m.BytesServed, size)
-	atomic.AddInt64(&m.ChunksServed, 1)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.BytesServed += size
+	m.ChunksServed++
 	m.AveragePrefetchGap = (m.AveragePrefetchGap*float64(m.ChunksServed-1) + gap) / float64(m.ChunksServed)
 }
+
+// RecordUnderrun records a write that nearly hit the write deadline
+func (m *StreamingMetrics) RecordUnderrun() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.BufferUnderruns++
+}
+
+// RecordTTFB records the time a stream took to send its first byte
+func (m *StreamingMetrics) RecordTTFB(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.FirstBytes++
+	m.TotalTTFB += d
+	m.MaxTTFB = max(m.MaxTTFB, d)
+}
+
+// Stats returns the streaming counters, with times in milliseconds
+func (m *StreamingMetrics) Stats() map[string]int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := map[string]int64{
+		"streamBytes":        m.BytesServed,
+		"streamChunks":       m.ChunksServed,
+		"averagePrefetchGap": int64(m.AveragePrefetchGap),
+		"bufferUnderruns":    m.BufferUnderruns,
+		"averageTtfbMs":      0,
+		"maxTtfbMs":          m.MaxTTFB.Milliseconds(),
+	}
+	if m.FirstBytes > 0 {
+		stats["averageTtfbMs"] = (m.TotalTTFB / time.Duration(m.FirstBytes)).Milliseconds()
+	}
+	return stats
+}
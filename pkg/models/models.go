@@ -1,8 +1,10 @@
 package models
 
 import (
+	"context"
 	"crypto/sha256"
 	"fmt"
+	"log/slog"
 	"net"
 	"path/filepath"
 	"strings"
@@ -12,35 +14,192 @@ import (
 	"golang.org/x/time/rate"
 )
 
-// VideoBuffer represents a prefetched segment of video
-type VideoBuffer struct {
-	Data        []byte
-	Start       int64
-	End         int64
-	LastAccess  time.Time
-	Mu          sync.RWMutex
-	Prefetching bool
-}
-
 // Metrics tracks server statistics
 type Metrics struct {
 	ActiveConnections int64
 	BytesTransferred  int64
 	RequestCount      int64
 	Errors            int64
-	PrefetchHits      int64
-	PrefetchMisses    int64
+	CacheHits         int64
+	CacheMisses       int64
+	CacheEvictions    int64
+	IdleEvictions     int64
+	StaleConnections  int64
+	RejectedConns     int64
+	RejectedRequests  int64
+	Bans              int64
+	Streaming         StreamingMetrics
 	Mu                sync.RWMutex
 }
 
 // Connection represents a client connection with rate limiting
 type Connection struct {
+	ID         uint64
 	Conn       net.Conn
-	Limiter    *rate.Limiter
+	Listener   string // Name of the listener that accepted it
+	RequestID  string
+	Log        *slog.Logger    // Carries the request ID
+	Limiters   []*rate.Limiter // Global, per-client and per-route caps
 	CreatedAt  time.Time
 	LastActive time.Time
-	Speed      float64
+	ActiveMu   sync.RWMutex
+	Speed      float64       // Bytes per second, recomputed every speedWindow while sending
+	Underruns  int64         // Writes of the current request that nearly hit the write deadline
+	TTFB       time.Duration // Time to the first body byte of the current request
 	SpeedMu    sync.RWMutex
+
+	speedWindowStart time.Time
+	speedWindowBytes int64
+
+	// What the connection is doing, for the admin dashboard
+	ClientIP string
+	Path     string
+	VideoID  string
+	Position int64 // Byte offset reached in the file being streamed
+	Waiting  bool  // Kept alive and waiting for the next request
+	StateMu  sync.RWMutex
+}
+
+// ConnectionInfo is a point-in-time view of a connection
+type ConnectionInfo struct {
+	ID        uint64    `json:"id"`
+	ClientIP  string    `json:"clientIp"`
+	Listener  string    `json:"listener"`
+	Path      string    `json:"path"`
+	VideoID   string    `json:"videoId"`
+	Position  int64     `json:"position"`
+	Speed     float64   `json:"speed"` // Bytes per second
+	Underruns int64     `json:"underruns"`
+	TTFB      float64   `json:"ttfbMs"`
+	CreatedAt time.Time `json:"createdAt"`
+	IdleFor   float64   `json:"idleFor"` // Seconds
+}
+
+// speedWindow is how much sending a connection's Speed is measured over
+const speedWindow = time.Second
+
+// SetRequest records the request the connection is now serving
+func (c *Connection) SetRequest(ip, path, videoID string) {
+	c.StateMu.Lock()
+	defer c.StateMu.Unlock()
+	c.ClientIP, c.Path, c.VideoID, c.Position = ip, path, videoID, 0
+
+	c.SpeedMu.Lock()
+	defer c.SpeedMu.Unlock()
+	c.Speed, c.Underruns, c.TTFB = 0, 0, 0
+	c.speedWindowStart, c.speedWindowBytes = time.Time{}, 0
+}
+
+// RecordSent adds n bytes to the connection's throughput. Each speedWindow
+// the rate over the window is blended into Speed, so it follows changes
+// within a few seconds without jumping on every write.
+func (c *Connection) RecordSent(n int64) {
+	c.SpeedMu.Lock()
+	defer c.SpeedMu.Unlock()
+
+	now := time.Now()
+	if c.speedWindowStart.IsZero() {
+		c.speedWindowStart = now
+	}
+	c.speedWindowBytes += n
+	if elapsed := now.Sub(c.speedWindowStart); elapsed >= speedWindow {
+		sample := float64(c.speedWindowBytes) / elapsed.Seconds()
+		if c.Speed == 0 {
+			c.Speed = sample
+		} else {
+			c.Speed = c.Speed/2 + sample/2
+		}
+		c.speedWindowStart, c.speedWindowBytes = now, 0
+	}
+}
+
+// RecordUnderrun counts a write that nearly hit the write deadline
+func (c *Connection) RecordUnderrun() {
+	c.SpeedMu.Lock()
+	defer c.SpeedMu.Unlock()
+	c.Underruns++
+}
+
+// SetTTFB records the time to first byte of the current request
+func (c *Connection) SetTTFB(d time.Duration) {
+	c.SpeedMu.Lock()
+	defer c.SpeedMu.Unlock()
+	c.TTFB = d
+}
+
+// SetWaiting marks the connection as between requests, or not
+func (c *Connection) SetWaiting(waiting bool) {
+	c.StateMu.Lock()
+	defer c.StateMu.Unlock()
+	c.Waiting = waiting
+}
+
+// IsWaiting reports whether the connection is between requests
+func (c *Connection) IsWaiting() bool {
+	c.StateMu.RLock()
+	defer c.StateMu.RUnlock()
+	return c.Waiting
+}
+
+// SetPosition records how far into the file a stream has got
+func (c *Connection) SetPosition(position int64) {
+	c.StateMu.Lock()
+	defer c.StateMu.Unlock()
+	c.Position = position
+}
+
+// Info returns a snapshot of the connection's state
+func (c *Connection) Info() ConnectionInfo {
+	c.StateMu.RLock()
+	info := ConnectionInfo{
+		ID:        c.ID,
+		ClientIP:  c.ClientIP,
+		Listener:  c.Listener,
+		Path:      c.Path,
+		VideoID:   c.VideoID,
+		Position:  c.Position,
+		CreatedAt: c.CreatedAt,
+	}
+	c.StateMu.RUnlock()
+
+	info.IdleFor = c.IdleFor().Seconds()
+
+	c.SpeedMu.RLock()
+	// A connection that has stopped sending has no current rate
+	if info.IdleFor < 2*speedWindow.Seconds() {
+		info.Speed = c.Speed
+	}
+	info.Underruns = c.Underruns
+	info.TTFB = float64(c.TTFB.Microseconds()) / 1000
+	c.SpeedMu.RUnlock()
+	return info
+}
+
+// WaitN blocks until every limiter on the connection allows n bytes
+func (c *Connection) WaitN(ctx context.Context, n int) error {
+	for _, limiter := range c.Limiters {
+		if err := limiter.WaitN(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Touch records activity on the connection
+func (c *Connection) Touch() {
+	c.ActiveMu.Lock()
+	defer c.ActiveMu.Unlock()
+	c.LastActive = time.Now()
+}
+
+// IdleFor returns how long the connection has been without activity
+func (c *Connection) IdleFor() time.Duration {
+	c.ActiveMu.RLock()
+	defer c.ActiveMu.RUnlock()
+	if c.LastActive.IsZero() {
+		return time.Since(c.CreatedAt)
+	}
+	return time.Since(c.LastActive)
 }
 
 // VideoFile represents a video file in the system
@@ -51,6 +210,60 @@ type VideoFile struct {
 	Title        string
 	Size         int64
 	LastModified time.Time
+	Subtitles    []SubtitleTrack
+	Media        *MediaInfo
+}
+
+// MediaInfo holds stream details probed from a video file
+type MediaInfo struct {
+	Duration    float64
+	Bitrate     int64
+	Width       int
+	Height      int
+	Subtitles   []SubtitleTrack
+	AudioTracks []AudioTrack
+}
+
+// AudioTrack represents an audio stream inside a video container
+type AudioTrack struct {
+	Index    int // Position among the file's audio streams, as used by ffmpeg's 0:a:N
+	Stream   int
+	Language string
+	Codec    string
+	Channels int
+	Label    string
+	Default  bool
+}
+
+// DefaultAudioTrack returns the index of the track browsers play from the raw file
+func (m *MediaInfo) DefaultAudioTrack() int {
+	for _, track := range m.AudioTracks {
+		if track.Default {
+			return track.Index
+		}
+	}
+	return 0
+}
+
+// SubtitleTrack represents a sidecar or embedded subtitle track
+type SubtitleTrack struct {
+	ID       string
+	Label    string
+	Language string
+	Format   string
+	Path     string // Sidecar file path, empty for embedded tracks
+	Stream   int    // ffprobe stream index for embedded tracks
+	Default  bool
+	Forced   bool
+}
+
+// AllSubtitles returns sidecar tracks followed by embedded ones
+func (v VideoFile) AllSubtitles() []SubtitleTrack {
+	tracks := append([]SubtitleTrack{}, v.Subtitles...)
+	if v.Media != nil {
+		tracks = append(tracks, v.Media.Subtitles...)
+	}
+	return tracks
 }
 
 // VideoStore manages video mappings and lookups
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// newLogger builds the JSON logger used for access and error logs
+func newLogger(config *Config) *slog.Logger {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(config.LogLevel)); err != nil {
+		level = slog.LevelInfo
+	}
+	return slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+}
+
+// newRequestID returns a random identifier for tracing a request
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// validRequestID reports whether an incoming X-Request-Id is safe to reuse
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// videoIDFromPath returns the video a request is about, if any
+func videoIDFromPath(path string) string {
+	for _, prefix := range []string{"/videos/", "/watch/", "/thumbnails/", "/previews/", "/subtitles/", "/trickplay/"} {
+		if rest, ok := strings.CutPrefix(path, prefix); ok {
+			id, _, _ := strings.Cut(rest, "/")
+			id, _, _ = strings.Cut(id, ".")
+			return id
+		}
+	}
+	return ""
+}
+
+// logAccess writes the access log entry for a finished request
+func (s *VideoServer) logAccess(w *Response, method, path, ip string, headers map[string]string, started time.Time) {
+	status := w.Status()
+
+	level := slog.LevelInfo
+	if status >= 500 || status == 0 {
+		level = slog.LevelError
+	}
+	attrs := []slog.Attr{
+		slog.String("method", method),
+		slog.String("path", path),
+		slog.Int("status", status),
+		slog.Int64("bytes", w.Written()),
+		slog.Float64("duration_ms", float64(time.Since(started).Microseconds())/1000),
+		slog.String("client_ip", ip),
+	}
+	if r := headers["Range"]; r != "" {
+		attrs = append(attrs, slog.String("range", r))
+	}
+	if id := videoIDFromPath(path); id != "" {
+		attrs = append(attrs, slog.String("video_id", id))
+	}
+	if ua := headers["User-Agent"]; ua != "" {
+		attrs = append(attrs, slog.String("user_agent", ua))
+	}
+	w.Conn.Log.LogAttrs(s.Ctx, level, "request", attrs...)
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strings"
+)
+
+// clientIP returns the IP address of the remote end of a connection. Peers
+// on a unix socket are local processes, so they are given the loopback
+// address.
+func clientIP(conn net.Conn) string {
+	if conn.LocalAddr().Network() == "unix" {
+		return "127.0.0.1"
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// isAdmin reports whether a request comes from one of AdminNetworks. It
+// must be given the resolved client IP so that requests relayed by a local
+// proxy are not all treated as local. A request relayed by a proxy that is
+// not in TrustedProxies is never an admin one, since its address is the
+// proxy's.
+func (s *VideoServer) isAdmin(conn net.Conn, ip string, headers map[string]string) bool {
+	if s.relayedByUntrustedProxy(conn, headers) {
+		return false
+	}
+	return inNetworks(net.ParseIP(ip), s.Config.AdminNetworks)
+}
+
+func (s *VideoServer) handleAdmin(w *Response, ip, method, path string, headers map[string]string, body *bufio.Reader) {
+	if !s.isAdmin(w.Conn.Conn, ip, headers) {
+		s.writeError(w, 403, "Forbidden")
+		s.Metrics.IncrementErrors()
+		return
+	}
+	if method != "GET" && !s.sameOrigin(w.Conn.Conn, headers) {
+		s.writeError(w, 403, "Forbidden")
+		s.Metrics.IncrementErrors()
+		return
+	}
+
+	switch {
+	case method == "GET" && (path == "/admin" || path == "/admin/"):
+		w.Header().Set("Cache-Control", "no-store")
+		s.renderPage(w, "admin.html", s.adminState())
+	case method == "GET" && path == "/admin/events":
+		s.serveAdminEvents(w)
+	case method == "GET" && path == "/admin/connections":
+		s.writeJSON(w, 200, s.adminState().Connections)
+	case method == "DELETE" && strings.HasPrefix(path, "/admin/connections/"):
+		s.kickConnection(w, strings.TrimPrefix(path, "/admin/connections/"))
+	case method == "POST" && path == "/admin/rescan":
+		videos, err := s.scanVideos()
+		if err != nil {
+			w.Conn.Log.Error("rescanning library", "error", err)
+		}
+		s.writeJSON(w, 200, map[string]int{"videos": len(videos)})
+	case method == "GET" && path == "/admin/stats":
+		s.writeJSON(w, 200, map[string]any{
+			"metrics":   s.Metrics.GetStats(),
+			"cache":     s.Cache.Stats(),
+			"jobs":      s.Jobs.Stats(),
+			"listeners": s.listenerStats(),
+		})
+	case method == "GET" && path == "/admin/limits":
+		s.writeJSON(w, 200, s.Shaper.Limits())
+	case (method == "POST" || method == "PUT") && path == "/admin/limits":
+		// Start from the current limits so partial updates leave the rest alone
+		data, ok := s.readBody(w, headers, body, 64*1024)
+		if !ok {
+			return
+		}
+		limits := s.Shaper.Limits()
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(data, &fields); err != nil {
+			s.writeError(w, 400, "Bad Request")
+			s.Metrics.IncrementErrors()
+			return
+		}
+		// A clientOverrides object replaces the overrides rather than being
+		// merged into them, so entries can be removed
+		if _, ok := fields["clientOverrides"]; ok {
+			limits.ClientOverrides = nil
+		}
+		if err := json.Unmarshal(data, &limits); err != nil {
+			s.writeError(w, 400, "Bad Request")
+			s.Metrics.IncrementErrors()
+			return
+		}
+		s.Shaper.SetLimits(limits)
+		s.writeJSON(w, 200, limits)
+	default:
+		s.writeError(w, 404, "Not Found")
+		s.Metrics.IncrementErrors()
+	}
+}
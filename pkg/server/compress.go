@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressible reports whether a response of this type is worth compressing.
+// Media is already compressed and byte ranges must stay byte-exact, so only
+// text formats qualify.
+func compressible(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	switch mediaType = strings.TrimSpace(mediaType); {
+	case strings.HasPrefix(mediaType, "text/"):
+		return true
+	case mediaType == "application/json", mediaType == "image/svg+xml",
+		mediaType == "application/vnd.apple.mpegurl", mediaType == "application/x-mpegurl":
+		return true
+	}
+	return false
+}
+
+// negotiateEncoding picks the content coding for an Accept-Encoding header:
+// the highest q-value among the ones we support, ties going to the earlier
+// entry in preferences. It returns "" when the body should be sent as is.
+func negotiateEncoding(accept string, preferences []string) string {
+	weights := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q="); ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			weights[name] = q
+		}
+	}
+
+	best, bestQ := "", 0.0
+	for _, coding := range preferences {
+		q, ok := weights[coding]
+		if !ok {
+			q, ok = weights["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+)
+
+// compress encodes data with the given content coding
+func (s *VideoServer) compress(data []byte, encoding string) ([]byte, error) {
+	var buf bytes.Buffer
+	switch encoding {
+	case "gzip":
+		w, err := gzip.NewWriterLevel(&buf, s.Config.GzipLevel)
+		if err != nil {
+			return nil, err
+		}
+		w.Write(data)
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	case "br":
+		w := brotli.NewWriterLevel(&buf, s.Config.BrotliLevel)
+		w.Write(data)
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	case "zstd":
+		// EncodeAll is safe for concurrent use, so one encoder is shared
+		zstdOnce.Do(func() {
+			zstdEncoder, _ = zstd.NewWriter(nil,
+				zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(s.Config.ZstdLevel)))
+		})
+		return zstdEncoder.EncodeAll(data, nil), nil
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q", encoding)
+	}
+	return buf.Bytes(), nil
+}
+
+// writeText sends a complete in-memory response, compressing it when the
+// type allows, the body is at least CompressMinSize and the client accepts
+// one of CompressEncodings. Other headers can be set on w beforehand.
+func (s *VideoServer) writeText(w *Response, status int, contentType string, body []byte) {
+	canCompress := compressible(contentType)
+	encoding := ""
+	if canCompress && len(body) >= s.Config.CompressMinSize {
+		encoding = negotiateEncoding(w.acceptEncoding, s.Config.CompressEncodings)
+	}
+	if encoding != "" {
+		compressed, err := s.compress(body, encoding)
+		if err != nil {
+			w.Conn.Log.Error("compressing response", "error", err, "encoding", encoding)
+			encoding = ""
+		} else {
+			body = compressed
+		}
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
+	}
+	if canCompress {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"ren.local/gocast/pkg/models"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	preferences := []string{"br", "zstd", "gzip"}
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"gzip, br", "br"},
+		{"GZIP", "gzip"},
+		{"gzip, deflate, br, zstd", "br"},
+		{"deflate", ""},
+		{"*", "br"},
+		{"gzip, *;q=0.5", "gzip"},
+		{"br;q=0, gzip", "gzip"},
+		{"br;q=0.5, gzip;q=0.8", "gzip"},
+		{"br; q=0.8, zstd;q=0.8", "br"},
+		{"zstd;q=0.8, br;q=0.8", "br"},
+		{"gzip;q=0", ""},
+		{"*;q=0", ""},
+		{"gzip;q=bogus", "gzip"},
+		{" , gzip ,", "gzip"},
+	}
+
+	for _, tt := range tests {
+		if got := negotiateEncoding(tt.accept, preferences); got != tt.want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+	if got := negotiateEncoding("br, gzip", []string{"gzip"}); got != "gzip" {
+		t.Errorf("unsupported coding chosen: %q", got)
+	}
+}
+
+// writeTextResponse answers one request with writeText and returns what the
+// client received, its body decoded
+func writeTextResponse(t *testing.T, s *VideoServer, accept, contentType string, content []byte) (*http.Response, []byte) {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		conn := &models.Connection{Conn: server, Log: s.Logger}
+		w := newResponse(conn, "HTTP/1.1", map[string]string{"Accept-Encoding": accept})
+		s.writeText(w, 200, contentType, content)
+		w.Finish()
+	}()
+
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var reader io.Reader = resp.Body
+	switch resp.Header.Get("Content-Encoding") {
+	case "gzip":
+		if reader, err = gzip.NewReader(resp.Body); err != nil {
+			t.Fatal(err)
+		}
+	case "br":
+		reader = brotli.NewReader(resp.Body)
+	case "zstd":
+		decoder, err := zstd.NewReader(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer decoder.Close()
+		reader = decoder
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, data
+}
+
+func TestWriteText(t *testing.T) {
+	config := DefaultConfig()
+	config.CompressMinSize = 1024
+	config.LogLevel = "error"
+	s := &VideoServer{Config: config, Logger: newLogger(config)}
+
+	large := []byte(strings.Repeat("gocast streams video. ", 100))
+	tests := []struct {
+		name        string
+		accept      string
+		contentType string
+		size        int
+		encoding    string
+		vary        bool
+	}{
+		{"below the threshold", "gzip, br", "text/html; charset=utf-8", 1023, "", true},
+		{"at the threshold", "gzip, br", "text/html; charset=utf-8", 1024, "br", true},
+		{"gzip only", "gzip", "text/html; charset=utf-8", len(large), "gzip", true},
+		{"zstd", "zstd, gzip", "application/json", len(large), "zstd", true},
+		{"playlist", "gzip", "application/vnd.apple.mpegurl", len(large), "gzip", true},
+		{"no Accept-Encoding", "", "text/vtt", len(large), "", true},
+		{"refused coding", "br;q=0", "text/css", len(large), "", true},
+		{"video", "gzip, br", "video/mp4", len(large), "", false},
+		{"image", "gzip, br", "image/jpeg", len(large), "", false},
+		{"octet stream", "gzip, br", "application/octet-stream", len(large), "", false},
+	}
+
+	for _, tt := range tests {
+		content := large[:tt.size]
+		resp, data := writeTextResponse(t, s, tt.accept, tt.contentType, content)
+		if encoding := resp.Header.Get("Content-Encoding"); encoding != tt.encoding {
+			t.Errorf("%s: Content-Encoding %q, want %q", tt.name, encoding, tt.encoding)
+		}
+		if vary := resp.Header.Get("Vary") == "Accept-Encoding"; vary != tt.vary {
+			t.Errorf("%s: Vary %q, want it set %v", tt.name, resp.Header.Get("Vary"), tt.vary)
+		}
+		if resp.Header.Get("Content-Type") != tt.contentType {
+			t.Errorf("%s: Content-Type %q", tt.name, resp.Header.Get("Content-Type"))
+		}
+		if !bytes.Equal(data, content) {
+			t.Errorf("%s: body does not round-trip", tt.name)
+		}
+		if tt.encoding != "" && resp.ContentLength >= int64(len(content)) {
+			t.Errorf("%s: compressed body of %d bytes is not smaller than %d", tt.name, resp.ContentLength, len(content))
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"ren.local/gocast/pkg/models"
+)
+
+// dashboardInterval is how often /admin/events sends a fresh snapshot
+const dashboardInterval = 2 * time.Second
+
+// adminState collects what the dashboard shows
+func (s *VideoServer) adminState() AdminTemplateData {
+	state := AdminTemplateData{
+		Connections: []AdminConnection{},
+		Metrics:     s.Metrics.GetStats(),
+		Cache:       s.Cache.Stats(),
+		Jobs:        s.Jobs.Stats(),
+		JobList:     s.Jobs.List(),
+		Listeners:   s.listenerStats(),
+		Limits:      s.Shaper.Limits(),
+		Videos:      len(s.VideoStore.GetAllVideos()),
+	}
+
+	s.Connections.Range(func(_, value any) bool {
+		info := AdminConnection{ConnectionInfo: value.(*models.Connection).Info()}
+		if video, ok := s.VideoStore.GetVideo(info.VideoID); ok {
+			info.Title = video.DisplayName
+			info.Size = video.Size
+		}
+		state.Connections = append(state.Connections, info)
+		return true
+	})
+	sort.Slice(state.Connections, func(i, j int) bool {
+		return state.Connections[i].ID < state.Connections[j].ID
+	})
+	return state
+}
+
+// serveAdminEvents streams adminState as server-sent events until the
+// client goes away or the server stops
+func (s *VideoServer) serveAdminEvents(w *Response) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	// Stop nginx from holding events back in its buffer
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.CloseAfter()
+
+	ticker := time.NewTicker(dashboardInterval)
+	defer ticker.Stop()
+
+	for {
+		data, err := json.Marshal(s.adminState())
+		if err != nil {
+			w.Conn.Log.Error("encoding dashboard state", "error", err)
+			return
+		}
+		w.SetWriteDeadline(time.Now().Add(s.Config.WriteTimeout))
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		if err := w.Flush(); err != nil {
+			return
+		}
+		w.Conn.Touch()
+
+		select {
+		case <-s.drain:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// kickConnection closes the connection with the given ID
+func (s *VideoServer) kickConnection(w *Response, id string) {
+	connID, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		s.writeError(w, 404, "Connection Not Found")
+		s.Metrics.IncrementErrors()
+		return
+	}
+	value, ok := s.Connections.Load(connID)
+	if !ok {
+		s.writeError(w, 404, "Connection Not Found")
+		s.Metrics.IncrementErrors()
+		return
+	}
+
+	// Closing unblocks the handler goroutine, which then deregisters
+	conn := value.(*models.Connection)
+	info := conn.Info()
+	conn.Conn.Close()
+	w.Conn.Log.Info("kicked connection", "kicked_id", connID, "client_ip", info.ClientIP)
+	s.writeJSON(w, 200, info)
+}
+
+// sameOrigin reports whether a state-changing admin request came from a
+// page on this server. Browsers send Origin with cross-site POST and DELETE
+// requests, so this stops another site from using the browser of someone on
+// an admin network; clients such as curl send no Origin and pass.
+func (s *VideoServer) sameOrigin(conn net.Conn, headers map[string]string) bool {
+	origin := headers["Origin"]
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	_, host := s.requestOrigin(conn, headers)
+	return u.Host == host
+}
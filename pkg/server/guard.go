@@ -0,0 +1,205 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"ren.local/gocast/pkg/models"
+)
+
+// Reasons a connection or request is turned away
+const (
+	RejectBanned      = "banned"
+	RejectTooManyConn = "too many connections"
+)
+
+var (
+	errHeaderTooLarge = errors.New("request header too large")
+	errTooManyHeaders = errors.New("too many request headers")
+)
+
+type guardClient struct {
+	conns       int
+	requests    *rate.Limiter
+	violations  int
+	windowStart time.Time
+	bannedUntil time.Time
+	lastSeen    time.Time
+}
+
+// Guard enforces per-IP connection and request limits and temporarily bans
+// clients that keep violating them
+type Guard struct {
+	mu      sync.Mutex
+	clients map[string]*guardClient
+	config  *Config
+	metrics *models.Metrics
+}
+
+// NewGuard creates a guard using the abuse protection settings in config
+func NewGuard(config *Config, metrics *models.Metrics) *Guard {
+	return &Guard{
+		clients: make(map[string]*guardClient),
+		config:  config,
+		metrics: metrics,
+	}
+}
+
+func (g *Guard) client(ip string) *guardClient {
+	c, ok := g.clients[ip]
+	if !ok {
+		c = &guardClient{
+			requests: rate.NewLimiter(rate.Limit(g.config.RequestRate), g.config.RequestBurst),
+		}
+		g.clients[ip] = c
+	}
+	c.lastSeen = time.Now()
+	return c
+}
+
+// Admit is called for each accepted connection. It returns "" if the
+// connection may proceed, in which case Release must be called when it
+// closes, or the reason it was rejected.
+func (g *Guard) Admit(ip string) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	c := g.client(ip)
+	if time.Now().Before(c.bannedUntil) {
+		return RejectBanned
+	}
+	if g.config.MaxConnsPerIP > 0 && c.conns >= g.config.MaxConnsPerIP {
+		g.violation(c)
+		return RejectTooManyConn
+	}
+	c.conns++
+	return ""
+}
+
+// Release returns a connection slot taken by Admit
+func (g *Guard) Release(ip string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if c, ok := g.clients[ip]; ok && c.conns > 0 {
+		c.conns--
+	}
+}
+
+// AllowRequest applies the per-IP request rate. Going over it is not a
+// violation: a busy page can briefly outrun the rate, and the 429 alone
+// slows it down without banning the viewer's streams with it.
+func (g *Guard) AllowRequest(ip string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	c := g.client(ip)
+	return g.config.RequestRate <= 0 || c.requests.Allow()
+}
+
+// Violation records misbehaviour such as malformed or slow requests
+func (g *Guard) Violation(ip string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.violation(g.client(ip))
+}
+
+// violation counts strikes within BanWindow and bans the client once it
+// reaches BanThreshold. Callers must hold g.mu.
+func (g *Guard) violation(c *guardClient) {
+	if g.config.BanThreshold <= 0 {
+		return
+	}
+	now := time.Now()
+	if now.Sub(c.windowStart) > g.config.BanWindow {
+		c.windowStart = now
+		c.violations = 0
+	}
+	c.violations++
+	if c.violations >= g.config.BanThreshold {
+		c.bannedUntil = now.Add(g.config.BanDuration)
+		c.violations = 0
+		if g.metrics != nil {
+			g.metrics.RecordBan()
+		}
+	}
+}
+
+// Banned returns the number of clients currently banned
+func (g *Guard) Banned() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	banned := 0
+	now := time.Now()
+	for _, c := range g.clients {
+		if now.Before(c.bannedUntil) {
+			banned++
+		}
+	}
+	return banned
+}
+
+// Cleanup forgets clients with no connections, no ban and no recent activity
+func (g *Guard) Cleanup(maxIdle time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	for ip, c := range g.clients {
+		if c.conns == 0 && now.After(c.bannedUntil) && now.Sub(c.lastSeen) > maxIdle {
+			delete(g.clients, ip)
+		}
+	}
+}
+
+// writeTooManyRequests sends a 429 asking the client to retry after the
+// given number of seconds, and closes the connection after it
+func (s *VideoServer) writeTooManyRequests(w *Response, retryAfter int, message string) {
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.CloseAfter()
+	s.writeText(w, 429, "text/plain; charset=utf-8", []byte(message))
+}
+
+// readRequestHead reads the request line and headers, enforcing the header
+// size and count caps so a client cannot make us buffer without bound
+func readRequestHead(reader *bufio.Reader, maxBytes, maxCount int) (string, map[string]string, error) {
+	total := 0
+	readLine := func() (string, error) {
+		line, err := reader.ReadSlice('\n')
+		total += len(line)
+		if err == bufio.ErrBufferFull || total > maxBytes {
+			return "", errHeaderTooLarge
+		}
+		return string(line), err
+	}
+
+	requestLine, err := readLine()
+	if err != nil {
+		return "", nil, err
+	}
+
+	headers := make(map[string]string)
+	for count := 0; ; count++ {
+		line, err := readLine()
+		if err != nil {
+			return "", nil, err
+		}
+		if line == "\r\n" || line == "\n" {
+			break
+		}
+		if count >= maxCount {
+			return "", nil, errTooManyHeaders
+		}
+		name, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if ok {
+			headers[textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))] = strings.TrimSpace(value)
+		}
+	}
+	return requestLine, headers, nil
+}
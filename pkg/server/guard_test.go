@@ -0,0 +1,327 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testGuardConfig is DefaultConfig with limits small enough to reach quickly
+func testGuardConfig() *Config {
+	config := DefaultConfig()
+	config.MaxConnsPerIP = 2
+	config.RequestRate = 1
+	config.RequestBurst = 3
+	config.BanThreshold = 3
+	config.BanWindow = time.Minute
+	config.BanDuration = time.Minute
+	return config
+}
+
+func TestRateLimitIsNotAViolation(t *testing.T) {
+	g := NewGuard(testGuardConfig(), nil)
+	allowed := 0
+	for i := 0; i < 50; i++ {
+		if g.AllowRequest("10.0.0.1") {
+			allowed++
+		}
+	}
+	if allowed != 3 {
+		t.Errorf("%d requests allowed, want the burst of 3", allowed)
+	}
+	if reason := g.Admit("10.0.0.1"); reason != "" || g.Banned() != 0 {
+		t.Errorf("client over the request rate was banned: %q", reason)
+	}
+}
+
+func TestReadRequestHead(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		bufSize  int // Reader buffer, 0 for the default
+		maxBytes int
+		maxCount int
+		line     string
+		headers  map[string]string
+		err      error
+	}{
+		{
+			name:  "request",
+			input: "GET /a HTTP/1.1\r\nhost: test\r\nx-forwarded-for:  10.0.0.1 \r\n\r\nbody",
+			line:  "GET /a HTTP/1.1\r\n",
+			headers: map[string]string{
+				"Host":            "test",
+				"X-Forwarded-For": "10.0.0.1",
+			},
+		},
+		{
+			name:    "bare newlines",
+			input:   "GET / HTTP/1.1\nHost: test\n\n",
+			line:    "GET / HTTP/1.1\n",
+			headers: map[string]string{"Host": "test"},
+		},
+		{
+			name:    "colon in value",
+			input:   "GET / HTTP/1.1\r\nHost: test:4221\r\n\r\n",
+			line:    "GET / HTTP/1.1\r\n",
+			headers: map[string]string{"Host": "test:4221"},
+		},
+		{
+			name:    "line without colon ignored",
+			input:   "GET / HTTP/1.1\r\nnonsense\r\nHost: test\r\n\r\n",
+			line:    "GET / HTTP/1.1\r\n",
+			headers: map[string]string{"Host": "test"},
+		},
+		{
+			name:     "as many headers as allowed",
+			input:    "GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\n\r\n",
+			maxCount: 2,
+			line:     "GET / HTTP/1.1\r\n",
+			headers:  map[string]string{"A": "1", "B": "2"},
+		},
+		{
+			name:     "too many headers",
+			input:    "GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\nC: 3\r\n\r\n",
+			maxCount: 2,
+			err:      errTooManyHeaders,
+		},
+		{
+			name:     "head over the byte cap",
+			input:    "GET / HTTP/1.1\r\nCookie: " + strings.Repeat("x", 100) + "\r\n\r\n",
+			maxBytes: 64,
+			err:      errHeaderTooLarge,
+		},
+		{
+			name:     "request line over the byte cap",
+			input:    "GET /" + strings.Repeat("x", 100) + " HTTP/1.1\r\n\r\n",
+			maxBytes: 64,
+			err:      errHeaderTooLarge,
+		},
+		{
+			name:    "line longer than the buffer",
+			input:   "GET / HTTP/1.1\r\nCookie: " + strings.Repeat("x", 100) + "\r\n\r\n",
+			bufSize: 32,
+			err:     errHeaderTooLarge,
+		},
+		{
+			name:  "cut off in the headers",
+			input: "GET / HTTP/1.1\r\nHost: te",
+			err:   io.EOF,
+		},
+		{
+			name:  "empty",
+			input: "",
+			err:   io.EOF,
+		},
+	}
+
+	for _, tt := range tests {
+		if tt.maxBytes == 0 {
+			tt.maxBytes = 16 << 10
+		}
+		if tt.maxCount == 0 {
+			tt.maxCount = 100
+		}
+		reader := bufio.NewReader(strings.NewReader(tt.input))
+		if tt.bufSize > 0 {
+			reader = bufio.NewReaderSize(strings.NewReader(tt.input), tt.bufSize)
+		}
+		line, headers, err := readRequestHead(reader, tt.maxBytes, tt.maxCount)
+		if err != tt.err {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err == nil && (line != tt.line || !reflect.DeepEqual(headers, tt.headers)) {
+			t.Errorf("%s: got %q %v, want %q %v", tt.name, line, headers, tt.line, tt.headers)
+		}
+	}
+}
+
+func TestGuardAdmit(t *testing.T) {
+	type step struct {
+		release bool // Release instead of Admit
+		ip      string
+		want    string
+	}
+	tests := []struct {
+		name      string
+		configure func(*Config)
+		steps     []step
+	}{
+		{
+			name: "per-IP cap",
+			steps: []step{
+				{ip: "10.0.0.1"},
+				{ip: "10.0.0.1"},
+				{ip: "10.0.0.1", want: RejectTooManyConn},
+				{ip: "10.0.0.2"},
+			},
+		},
+		{
+			name: "release frees a slot",
+			steps: []step{
+				{ip: "10.0.0.1"},
+				{ip: "10.0.0.1"},
+				{release: true, ip: "10.0.0.1"},
+				{ip: "10.0.0.1"},
+			},
+		},
+		{
+			name: "release of an unknown client",
+			steps: []step{
+				{release: true, ip: "10.0.0.1"},
+				{ip: "10.0.0.1"},
+				{ip: "10.0.0.1"},
+				{ip: "10.0.0.1", want: RejectTooManyConn},
+			},
+		},
+		{
+			name:      "no cap",
+			configure: func(c *Config) { c.MaxConnsPerIP = 0 },
+			steps: []step{
+				{ip: "10.0.0.1"},
+				{ip: "10.0.0.1"},
+				{ip: "10.0.0.1"},
+				{ip: "10.0.0.1"},
+			},
+		},
+		{
+			name: "going over the cap is a violation",
+			steps: []step{
+				{ip: "10.0.0.1"},
+				{ip: "10.0.0.1"},
+				{ip: "10.0.0.1", want: RejectTooManyConn},
+				{ip: "10.0.0.1", want: RejectTooManyConn},
+				{ip: "10.0.0.1", want: RejectTooManyConn},
+				{release: true, ip: "10.0.0.1"},
+				{ip: "10.0.0.1", want: RejectBanned},
+				{ip: "10.0.0.2"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		config := testGuardConfig()
+		if tt.configure != nil {
+			tt.configure(config)
+		}
+		g := NewGuard(config, nil)
+		for i, step := range tt.steps {
+			if step.release {
+				g.Release(step.ip)
+				continue
+			}
+			if reason := g.Admit(step.ip); reason != step.want {
+				t.Errorf("%s: step %d: Admit(%s) = %q, want %q", tt.name, i, step.ip, reason, step.want)
+			}
+		}
+	}
+}
+
+func TestGuardAllowRequest(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(*Config)
+		ips       []string // One request each, in order
+		allowed   int
+	}{
+		{"burst", nil, []string{"a", "a", "a", "a", "a"}, 3},
+		{"per IP", nil, []string{"a", "a", "a", "a", "b", "b", "b", "b"}, 6},
+		{"no rate", func(c *Config) { c.RequestRate = 0 }, []string{"a", "a", "a", "a", "a"}, 5},
+	}
+
+	for _, tt := range tests {
+		config := testGuardConfig()
+		if tt.configure != nil {
+			tt.configure(config)
+		}
+		g := NewGuard(config, nil)
+		allowed := 0
+		for _, ip := range tt.ips {
+			if g.AllowRequest(ip) {
+				allowed++
+			}
+		}
+		if allowed != tt.allowed {
+			t.Errorf("%s: %d requests allowed, want %d", tt.name, allowed, tt.allowed)
+		}
+	}
+}
+
+func TestGuardBans(t *testing.T) {
+	tests := []struct {
+		name       string
+		configure  func(*Config)
+		violations int
+		expire     int // Violations after which the window is moved past BanWindow
+		banned     bool
+	}{
+		{name: "below the threshold", violations: 2},
+		{name: "at the threshold", violations: 3, banned: true},
+		{name: "bans disabled", configure: func(c *Config) { c.BanThreshold = 0 }, violations: 10},
+		{name: "window expired", violations: 4, expire: 2},
+		{name: "threshold reached in a new window", violations: 5, expire: 2, banned: true},
+	}
+
+	for _, tt := range tests {
+		config := testGuardConfig()
+		if tt.configure != nil {
+			tt.configure(config)
+		}
+		g := NewGuard(config, nil)
+		for i := 1; i <= tt.violations; i++ {
+			g.Violation("10.0.0.1")
+			if i == tt.expire {
+				g.clients["10.0.0.1"].windowStart = time.Now().Add(-2 * config.BanWindow)
+			}
+		}
+		if banned := g.Banned() == 1; banned != tt.banned {
+			t.Errorf("%s: banned %v, want %v", tt.name, banned, tt.banned)
+		}
+		if banned := g.Admit("10.0.0.1") == RejectBanned; banned != tt.banned {
+			t.Errorf("%s: Admit rejected as banned %v, want %v", tt.name, banned, tt.banned)
+		}
+	}
+
+	// A ban lifts once BanDuration has passed
+	g := NewGuard(testGuardConfig(), nil)
+	for i := 0; i < 3; i++ {
+		g.Violation("10.0.0.1")
+	}
+	g.clients["10.0.0.1"].bannedUntil = time.Now().Add(-time.Second)
+	if reason := g.Admit("10.0.0.1"); reason != "" || g.Banned() != 0 {
+		t.Errorf("expired ban still applied: %q", reason)
+	}
+}
+
+func TestGuardCleanup(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(g *Guard, ip string)
+		maxIdle time.Duration
+		kept    bool
+	}{
+		{"idle", func(g *Guard, ip string) { g.AllowRequest(ip) }, time.Minute, false},
+		{"recently seen", func(g *Guard, ip string) { g.AllowRequest(ip) }, time.Hour, true},
+		{"connected", func(g *Guard, ip string) { g.Admit(ip) }, time.Minute, true},
+		{"released", func(g *Guard, ip string) { g.Admit(ip); g.Release(ip) }, time.Minute, false},
+		{"banned", func(g *Guard, ip string) {
+			for i := 0; i < 3; i++ {
+				g.Violation(ip)
+			}
+		}, time.Minute, true},
+	}
+
+	for _, tt := range tests {
+		g := NewGuard(testGuardConfig(), nil)
+		tt.prepare(g, "10.0.0.1")
+		g.clients["10.0.0.1"].lastSeen = time.Now().Add(-10 * time.Minute)
+		g.Cleanup(tt.maxIdle)
+		if _, kept := g.clients["10.0.0.1"]; kept != tt.kept {
+			t.Errorf("%s: client kept %v, want %v", tt.name, kept, tt.kept)
+		}
+	}
+}
@@ -2,18 +2,19 @@ package server
 
 import (
 	"bufio"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"mime"
 	"net"
+	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
-	"golang.org/x/time/rate"
 	"ren.local/gocast/pkg/models"
 )
 
@@ -34,77 +35,240 @@ var supportedFormats = map[string]bool{
 	".m2ts": true,
 }
 
-// Add this struct for the watch page template data
-type WatchTemplateData struct {
-	Title        string
-	VideoID      string
-	Size         int64
-	LastModified time.Time
+// handleConnection serves requests on a connection until the client closes
+// it, a response cannot be followed by another, or it sits idle for longer
+// than IdleTimeout
+func (s *VideoServer) handleConnection(l *Listener, conn *models.Connection) {
+	peer := clientIP(conn.Conn)
+	proxied := s.fromTrustedProxy(conn.Conn)
+	reader := bufio.NewReaderSize(conn.Conn, s.Config.MaxHeaderBytes)
+
+	for first := true; ; first = false {
+		if !first {
+			// HeaderTimeout starts once the next request begins to arrive.
+			// The deadline is set before the connection is marked waiting,
+			// so a Stop that sees it waiting cuts the deadline short; a Stop
+			// that does not has already begun draining, which is checked
+			// after.
+			conn.Conn.SetReadDeadline(time.Now().Add(s.Config.IdleTimeout))
+			conn.SetWaiting(true)
+			if s.draining() {
+				conn.SetWaiting(false)
+				return
+			}
+			_, err := reader.Peek(1)
+			conn.SetWaiting(false)
+			if err != nil || s.draining() {
+				return
+			}
+		}
+		if !s.serveRequest(l, conn, reader, peer, proxied) {
+			return
+		}
+	}
 }
 
-func (s *VideoServer) handleConnection(conn *models.Connection) {
-	reader := bufio.NewReader(conn.Conn)
-	requestLine, err := reader.ReadString('\n')
+// serveRequest reads and answers one request, and reports whether the
+// connection can be kept open for another
+func (s *VideoServer) serveRequest(l *Listener, conn *models.Connection, reader *bufio.Reader, peer string, proxied bool) (keepAlive bool) {
+	started := time.Now()
+	conn.Log = s.Logger.With("conn_id", conn.ID)
+
+	// Bound how long a client may take to send the request head. A
+	// connection that sends nothing at all, such as a browser's speculative
+	// preconnect, is closed without an answer and is not a violation.
+	conn.Conn.SetReadDeadline(time.Now().Add(s.Config.HeaderTimeout))
+	if _, err := reader.Peek(1); err != nil {
+		return false
+	}
+	requestLine, headers, err := readRequestHead(reader, s.Config.MaxHeaderBytes, s.Config.MaxHeaderCount)
+	conn.Conn.SetReadDeadline(time.Time{})
 	if err != nil {
-		log.Printf("Failed to read request: %v", err)
-		s.writeError(conn.Conn, 400, "Bad Request")
+		w := newResponse(conn, "HTTP/1.1", nil)
+		w.CloseAfter()
+		defer w.Finish()
+
+		// Until the headers are read we only know the peer, and a proxy must
+		// not be banned for one of its clients
+		if err == errHeaderTooLarge || err == errTooManyHeaders {
+			if !proxied {
+				s.Guard.Violation(peer)
+			}
+			s.Metrics.RecordRejectedRequest()
+			conn.Log.Warn("rejected request", "reason", err.Error(), "client_ip", peer)
+			s.writeError(w, 431, "Request Header Fields Too Large")
+			return false
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			if s.draining() {
+				// Stop woke the connection just as a request arrived
+				return false
+			}
+			if !proxied {
+				s.Guard.Violation(peer)
+			}
+			s.Metrics.RecordRejectedRequest()
+			conn.Log.Warn("rejected request", "reason", "header timeout", "client_ip", peer)
+			s.writeError(w, 408, "Request Timeout")
+			return false
+		}
+		if err != io.EOF {
+			conn.Log.Warn("reading request", "error", err, "client_ip", peer)
+		}
+		s.writeError(w, 400, "Bad Request")
+		s.Metrics.IncrementErrors()
+		return false
+	}
+
+	ip := s.requestIP(conn.Conn, headers)
+	parts := strings.Split(strings.TrimSpace(requestLine), " ")
+	proto := "HTTP/1.1"
+	if len(parts) == 3 {
+		proto = parts[2]
+	}
+	w := newResponse(conn, proto, headers)
+	w.started = started
+	if s.draining() {
+		w.CloseAfter()
+	}
+
+	// Reuse the proxy's request ID so its logs and ours line up
+	conn.RequestID = newRequestID()
+	if id := headers["X-Request-Id"]; validRequestID(id) && proxied {
+		conn.RequestID = id
+	}
+	w.RequestID = conn.RequestID
+	conn.Log = conn.Log.With("request_id", conn.RequestID)
+
+	// An unread request body would be taken for the next request, so only
+	// bodiless requests keep the connection open
+	if (headers["Content-Length"] != "" && headers["Content-Length"] != "0") || headers["Transfer-Encoding"] != "" {
+		w.CloseAfter()
+	}
+
+	var method, path string
+	defer func() {
+		w.Finish()
+		l.requests.Add(1)
+		l.bytes.Add(w.Written())
+		s.logAccess(w, method, path, ip, headers, started)
+		keepAlive = w.KeepAlive() && !s.draining()
+	}()
+
+	// Parse request line
+	if len(parts) != 3 {
+		w.CloseAfter()
+		s.writeError(w, 400, "Bad Request")
 		s.Metrics.IncrementErrors()
 		return
 	}
 
-	s.Metrics.IncrementRequests()
-	conn.LastActive = time.Now()
-
-	// Parse HTTP headers
-	headers := make(map[string]string)
-	for {
-		line, err := reader.ReadString('\n')
-		if err != nil || line == "\r\n" || line == "\n" {
-			break
+	method = parts[0]
+	path, rawQuery, _ := strings.Cut(parts[1], "?")
+	query, _ := url.ParseQuery(rawQuery)
+
+	// Route relative to BasePath. Proxies that already strip the prefix
+	// send bare paths, which are accepted as they are.
+	if base := s.Config.BasePath; base != "" {
+		if path == base {
+			s.redirect(w, headers, "/")
+			return
 		}
-		parts := strings.SplitN(strings.TrimSpace(line), ":", 2)
-		if len(parts) == 2 {
-			headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		path = strings.TrimPrefix(path, base+"/")
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
 		}
 	}
 
-	// Parse request line
-	parts := strings.Split(strings.TrimSpace(requestLine), " ")
-	if len(parts) != 3 {
-		s.writeError(conn.Conn, 400, "Bad Request")
+	// Routes this listener does not serve do not exist on it
+	if !l.serves(routeGroup(path)) {
+		s.writeError(w, 404, "Not Found")
 		s.Metrics.IncrementErrors()
 		return
 	}
 
-	method, path, _ := parts[0], parts[1], parts[2]
+	// Health checks must answer even when the client is over its limits
+	if method == "GET" && probePaths[path] {
+		s.handleProbe(w, path)
+		return
+	}
+
+	// Connections from a proxy skipped admission in acceptConnections, so
+	// the client it forwards for is admitted here instead
+	if proxied {
+		if reason := s.Guard.Admit(ip); reason != "" {
+			s.Metrics.RecordRejectedConnection()
+			conn.Log.Warn("rejected connection", "reason", reason, "client_ip", ip)
+			s.writeTooManyRequests(w, 10, reason)
+			return
+		}
+		defer s.Guard.Release(ip)
+	}
+
+	if !s.Guard.AllowRequest(ip) {
+		s.Metrics.RecordRejectedRequest()
+		s.writeTooManyRequests(w, 1, "Too Many Requests")
+		return
+	}
+
+	release := s.Shaper.Attach(conn, ip)
+	defer release()
+
+	s.Metrics.IncrementRequests()
+	conn.Touch()
+	conn.SetRequest(ip, path, videoIDFromPath(path))
 
 	switch {
 	case method == "GET" && path == "/":
-		s.serveVideoList(conn.Conn)
+		s.serveVideoList(w)
 	case method == "GET" && strings.HasPrefix(path, "/videos/"):
 		videoID := filepath.Base(path)
 		if video, exists := s.VideoStore.GetVideo(videoID); exists {
+			video = s.probeVideo(video)
+			release := s.Shaper.AttachRoute(conn, ip, RouteVideo, video.VideoID, video.Media.Bitrate)
+			defer release()
+
 			videoFile := filepath.Join(s.Config.VideoDir, video.Name)
-			s.serveVideo(conn, videoFile, headers)
+			if query.Has("audio") {
+				s.serveAudioTrack(w, video, query)
+			} else {
+				s.serveVideo(w, videoFile, headers)
+			}
 		} else {
-			s.writeError(conn.Conn, 404, "Video Not Found")
+			s.writeError(w, 404, "Video Not Found")
 			s.Metrics.IncrementErrors()
 		}
 	case method == "GET" && strings.HasPrefix(path, "/watch/"):
 		videoID := filepath.Base(path)
-		s.serveWatchPage(conn.Conn, videoID)
+		s.serveWatchPage(w, videoID)
 	case method == "GET" && strings.HasPrefix(path, "/thumbnails/"):
-		s.handleThumbnail(conn.Conn, path)
+		s.handleThumbnail(w, ip, path, query, headers)
+	case (method == "POST" || method == "DELETE") && strings.HasPrefix(path, "/thumbnails/"):
+		s.updateThumbnail(w, ip, method, path, query, headers, reader)
+	case method == "GET" && strings.HasPrefix(path, "/subtitles/"):
+		s.handleSubtitle(w, path)
+	case method == "GET" && strings.HasPrefix(path, "/previews/"):
+		release := s.Shaper.AttachRoute(conn, ip, RouteVideo, path, 0)
+		defer release()
+		s.handlePreview(w, path, headers)
+	case path == "/admin" || strings.HasPrefix(path, "/admin/"):
+		s.handleAdmin(w, ip, method, path, headers, reader)
+	case method == "GET" && strings.HasPrefix(path, "/static/"):
+		s.handleStatic(w, path, headers)
+	case method == "GET" && strings.HasPrefix(path, "/trickplay/"):
+		s.handleTrickplay(w, path)
 	default:
-		s.writeError(conn.Conn, 404, "Not Found")
+		s.writeError(w, 404, "Not Found")
 		s.Metrics.IncrementErrors()
 	}
+	return
 }
 
-func (s *VideoServer) serveVideo(conn *models.Connection, path string, headers map[string]string) {
+func (s *VideoServer) serveVideo(w *Response, path string, headers map[string]string) {
 	file, err := os.Open(path)
 	if err != nil {
-		s.writeError(conn.Conn, 404, "Video Not Found")
+		s.writeError(w, 404, "Video Not Found")
 		s.Metrics.IncrementErrors()
 		return
 	}
@@ -112,25 +276,20 @@ func (s *VideoServer) serveVideo(conn *models.Connection, path string, headers m
 
 	fileInfo, err := file.Stat()
 	if err != nil {
-		s.writeError(conn.Conn, 500, "Internal Server Error")
+		s.writeError(w, 500, "Internal Server Error")
 		s.Metrics.IncrementErrors()
 		return
 	}
 
-	rangeHeader := headers["Range"]
-	start, end := int64(0), fileInfo.Size()-1
-
-	if rangeHeader != "" {
-		if strings.HasPrefix(rangeHeader, "bytes=") {
-			rangeHeader = strings.TrimPrefix(rangeHeader, "bytes=")
-			parts := strings.Split(rangeHeader, "-")
-			if len(parts) == 2 {
-				start, _ = strconv.ParseInt(parts[0], 10, 64)
-				if parts[1] != "" {
-					end, _ = strconv.ParseInt(parts[1], 10, 64)
-				}
-			}
-		}
+	start, end, partial, err := parseRange(headers["Range"], fileInfo.Size())
+	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", fileInfo.Size()))
+		s.writeError(w, 416, "Range Not Satisfiable")
+		s.Metrics.IncrementErrors()
+		return
+	}
+	if !partial {
+		start, end = 0, fileInfo.Size()-1
 	}
 
 	// Write headers
@@ -140,195 +299,249 @@ func (s *VideoServer) serveVideo(conn *models.Connection, path string, headers m
 		contentType = "application/octet-stream"
 	}
 
-	if rangeHeader != "" {
-		conn.Conn.Write([]byte("HTTP/1.1 206 Partial Content\r\n"))
-		conn.Conn.Write([]byte(fmt.Sprintf("Content-Range: bytes %d-%d/%d\r\n", start, end, fileInfo.Size())))
+	w.Header().Set("Content-Length", strconv.FormatInt(contentLength, 10))
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Accept-Ranges", "bytes")
+	if partial {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, fileInfo.Size()))
+		w.WriteHeader(206)
 	} else {
-		conn.Conn.Write([]byte("HTTP/1.1 200 OK\r\n"))
+		w.WriteHeader(200)
 	}
 
-	conn.Conn.Write([]byte(fmt.Sprintf("Content-Length: %d\r\n", contentLength)))
-	conn.Conn.Write([]byte(fmt.Sprintf("Content-Type: %s\r\n", contentType)))
-	conn.Conn.Write([]byte("Accept-Ranges: bytes\r\n"))
-	conn.Conn.Write([]byte("\r\n"))
-
 	// Seek to start position
 	file.Seek(start, 0)
 
 	// Start streaming
-	s.streamVideo(conn, file, start, end)
+	s.streamVideo(w, file, start, end)
 }
 
-func (s *VideoServer) serveVideoList(conn net.Conn) {
-	videos, err := s.scanVideos()
-	if err != nil {
-		s.writeError(conn, 500, "Internal Server Error")
-		s.Metrics.IncrementErrors()
-		return
+// errBadRange is returned by parseRange for a range the file cannot satisfy
+var errBadRange = errors.New("invalid or unsatisfiable range")
+
+// parseRange reads the byte range of a Range header for a file of size
+// bytes. partial is false when the whole file should be sent instead: the
+// header is absent, not in bytes, or asks for several ranges, which are not
+// supported. The end of the range is clamped to the last byte of the file.
+func parseRange(header string, size int64) (start, end int64, partial bool, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, false, nil
 	}
-
-	conn.Write([]byte("HTTP/1.1 200 OK\r\n"))
-	conn.Write([]byte("Content-Type: text/html\r\n"))
-	conn.Write([]byte("\r\n"))
-
-	err = s.Template.ExecuteTemplate(conn, "video_list.html", struct {
-		Videos []models.VideoFile
-	}{
-		Videos: videos,
-	})
-	if err != nil {
-		log.Printf("Error executing template: %v", err)
-		s.Metrics.IncrementErrors()
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, 0, false, errBadRange
 	}
-}
-
-func (s *VideoServer) writeError(conn net.Conn, status int, message string) {
-	conn.Write([]byte(fmt.Sprintf("HTTP/1.1 %d %s\r\n", status, message)))
-	conn.Write([]byte("Content-Type: text/plain\r\n\r\n"))
-	conn.Write([]byte(message))
-}
 
-func (s *VideoServer) scanVideos() ([]models.VideoFile, error) {
-	err := filepath.Walk(s.Config.VideoDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+	if first == "" {
+		// A suffix range: the last n bytes
+		n, ok := parseRangeInt(last)
+		if !ok || n == 0 || size == 0 {
+			return 0, 0, false, errBadRange
 		}
-		if !info.IsDir() {
-			ext := strings.ToLower(filepath.Ext(path))
-			if supportedFormats[ext] {
-				name := filepath.Base(path)
-				displayName := s.VideoStore.CleanDisplayName(name)
-				video := models.VideoFile{
-					Name:         name,
-					DisplayName:  displayName,
-					Title:        displayName,
-					Size:         info.Size(),
-					LastModified: info.ModTime(),
-				}
-				video.VideoID = s.VideoStore.GenerateID(name)
-
-				// Generate thumbnail for the video
-				thumbnailPath := filepath.Join(s.Config.ThumbnailDir, video.VideoID+".jpg")
-				if _, err := os.Stat(thumbnailPath); os.IsNotExist(err) {
-					if err := s.generateVideoThumbnail(path, thumbnailPath); err != nil {
-						log.Printf("Error generating thumbnail for %s: %v", name, err)
-					}
-				}
-
-				s.VideoStore.AddVideo(video)
-			}
+		return size - min(n, size), size - 1, true, nil
+	}
+
+	start, ok = parseRangeInt(first)
+	if !ok || start >= size {
+		return 0, 0, false, errBadRange
+	}
+	end = size - 1
+	if last != "" {
+		if end, ok = parseRangeInt(last); !ok || end < start {
+			return 0, 0, false, errBadRange
 		}
-		return nil
-	})
-	return s.VideoStore.GetAllVideos(), err
+		end = min(end, size-1)
+	}
+	return start, end, true, nil
 }
 
-func (s *VideoServer) generateVideoThumbnail(videoPath, thumbnailPath string) error {
-	cmd := exec.Command("ffmpeg",
-		"-i", videoPath, // Input file
-		"-ss", "00:00:01", // Seek to 1 second
-		"-vframes", "1", // Extract 1 frame
-		"-vf", fmt.Sprintf("scale=%d:-1", s.Config.ThumbnailWidth), // Scale width, maintain aspect ratio
-		"-q:v", strconv.Itoa(s.Config.ThumbnailQuality), // JPEG quality (1-31, lower is better)
-		"-y",          // Overwrite output file
-		thumbnailPath, // Output file
-	)
-
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("ffmpeg error: %v, output: %s", err, string(output))
+// parseRangeInt parses a position in a Range header, which is digits only
+func parseRangeInt(s string) (int64, bool) {
+	if s == "" || strings.Trim(s, "0123456789") != "" {
+		return 0, false
 	}
-
-	return nil
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n, err == nil
 }
 
-func (s *VideoServer) serveWatchPage(conn net.Conn, videoID string) {
-	video, exists := s.VideoStore.GetVideo(videoID)
-	if !exists {
-		s.writeError(conn, 404, "Video Not Found")
+// serveAudioTrack streams a video remuxed with a non-default audio track,
+// e.g. /videos/{id}?audio=1&t=120.5
+func (s *VideoServer) serveAudioTrack(w *Response, video models.VideoFile, query url.Values) {
+	video = s.probeVideo(video)
+	videoFile := filepath.Join(s.Config.VideoDir, video.Name)
+
+	index, err := strconv.Atoi(query.Get("audio"))
+	if err != nil || index < 0 || index >= len(video.Media.AudioTracks) {
+		s.writeError(w, 404, "Audio Track Not Found")
 		s.Metrics.IncrementErrors()
 		return
 	}
 
-	data := WatchTemplateData{
-		Title:        video.DisplayName,
-		VideoID:      video.VideoID,
-		Size:         video.Size,
-		LastModified: video.LastModified,
+	offset, _ := strconv.ParseFloat(query.Get("t"), 64)
+	if offset < 0 {
+		offset = 0
 	}
 
-	conn.Write([]byte("HTTP/1.1 200 OK\r\n"))
-	conn.Write([]byte("Content-Type: text/html\r\n"))
-	conn.Write([]byte("\r\n"))
+	s.streamRemux(w, videoFile, video.Media.AudioTracks[index], offset)
+}
 
-	err := s.Template.ExecuteTemplate(conn, "watch.html", data)
+func (s *VideoServer) serveVideoList(w *Response) {
+	videos, err := s.scanVideos()
 	if err != nil {
-		log.Printf("Error executing template: %v", err)
+		s.writeError(w, 500, "Internal Server Error")
 		s.Metrics.IncrementErrors()
+		return
 	}
-}
 
-func (s *VideoServer) handleThumbnail(conn net.Conn, path string) {
-	videoID := filepath.Base(path)
+	pending := make(map[string]bool)
+	for _, video := range videos {
+		if !fileExists(s.thumbnailPath(video.VideoID)) {
+			pending[video.VideoID] = true
+		}
+	}
 
-	// Path to thumbnail cache
-	thumbnailPath := filepath.Join(s.Config.ThumbnailDir, videoID+".jpg")
-	videoPath := filepath.Join(s.Config.VideoDir, videoID)
+	s.renderPage(w, "video_list.html", ListTemplateData{
+		Videos:          videos,
+		Pending:         pending,
+		ThumbnailWidths: s.Config.ThumbnailWidths,
+	})
+}
 
-	// Check if thumbnail already exists
-	if _, err := os.Stat(thumbnailPath); os.IsNotExist(err) {
-		// Generate thumbnail using ffmpeg
-		err = generateThumbnail(videoPath, thumbnailPath)
-		if err != nil {
-			s.writeError(conn, 500, "Internal Server Error")
-			s.Metrics.IncrementErrors()
-			return
-		}
+// readBody reads a request body declared with Content-Length, up to limit
+// bytes. On failure it writes the error response and returns false.
+func (s *VideoServer) readBody(w *Response, headers map[string]string, body *bufio.Reader, limit int64) ([]byte, bool) {
+	length, err := strconv.ParseInt(headers["Content-Length"], 10, 64)
+	if err != nil || length < 0 {
+		s.writeError(w, 411, "Length Required")
+		s.Metrics.IncrementErrors()
+		return nil, false
+	}
+	if length > limit {
+		s.writeError(w, 413, "Payload Too Large")
+		s.Metrics.IncrementErrors()
+		return nil, false
 	}
 
-	thumbnailFile, err := os.Open(thumbnailPath)
-	if err != nil {
-		s.writeError(conn, 500, "Internal Server Error")
+	data := make([]byte, length)
+	w.Conn.Conn.SetReadDeadline(time.Now().Add(s.Config.ReadTimeout))
+	if _, err := io.ReadFull(body, data); err != nil {
+		s.writeError(w, 400, "Bad Request")
 		s.Metrics.IncrementErrors()
-		return
+		return nil, false
 	}
-	defer thumbnailFile.Close()
+	return data, true
+}
 
-	thumbnailFileInfo, err := thumbnailFile.Stat()
+// writeJSON sends v as a JSON response
+func (s *VideoServer) writeJSON(w *Response, status int, v any) {
+	body, err := json.Marshal(v)
 	if err != nil {
-		s.writeError(conn, 500, "Internal Server Error")
+		s.writeError(w, 500, "Internal Server Error")
 		s.Metrics.IncrementErrors()
 		return
 	}
 
-	// Write headers
-	conn.Write([]byte("HTTP/1.1 200 OK\r\n"))
-	conn.Write([]byte("Content-Type: image/jpeg\r\n"))
-	conn.Write([]byte(fmt.Sprintf("Content-Length: %d\r\n", thumbnailFileInfo.Size())))
-	conn.Write([]byte("\r\n"))
+	w.Header().Set("Cache-Control", "no-store")
+	s.writeText(w, status, "application/json", body)
+}
+
+func (s *VideoServer) writeError(w *Response, status int, message string) {
+	s.writeText(w, status, "text/plain; charset=utf-8", []byte(message))
+}
 
-	// Create a models.Connection with default rate limiter for thumbnail
-	thumbnailConn := &models.Connection{
-		Conn:       conn,
-		Limiter:    rate.NewLimiter(rate.Limit(1024*1024), 1024*1024), // 1MB/s limit for thumbnails
-		CreatedAt:  time.Now(),
-		LastActive: time.Now(),
+// scanVideos indexes VideoDir and queues thumbnails and previews for any
+// video that needs them
+func (s *VideoServer) scanVideos() ([]models.VideoFile, error) {
+	found, errs := s.walkLibrary()
+	for _, video := range found {
+		// Generate thumbnail for the video in the background
+		if s.thumbnailStale(video) {
+			s.queueThumbnail(video, PriorityLow)
+		}
+		if s.previewStale(video) {
+			s.queuePreview(video, PriorityLow)
+		}
 	}
+	return s.VideoStore.GetAllVideos(), errors.Join(errs...)
+}
 
-	// Start streaming
-	s.streamVideo(thumbnailConn, thumbnailFile, 0, thumbnailFileInfo.Size()-1)
+// walkLibrary adds every supported file under VideoDir to the store and
+// returns them. Unreadable directories are skipped and reported rather than
+// ending the walk.
+func (s *VideoServer) walkLibrary() ([]models.VideoFile, []error) {
+	var found []models.VideoFile
+	var errs []error
+	dirCache := make(map[string][]os.DirEntry)
+	filepath.Walk(s.Config.VideoDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			errs = append(errs, err)
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() || !supportedFormats[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+
+		name := filepath.Base(path)
+		displayName := s.VideoStore.CleanDisplayName(name)
+		video := models.VideoFile{
+			Name:         name,
+			DisplayName:  displayName,
+			Title:        displayName,
+			Size:         info.Size(),
+			LastModified: info.ModTime(),
+		}
+		video.VideoID = s.VideoStore.GenerateID(name)
+		video.Subtitles = findSidecarSubtitles(path, dirCache)
+
+		// Keep probed stream info unless the file has changed
+		if existing, ok := s.VideoStore.GetVideo(video.VideoID); ok &&
+			existing.Size == video.Size && existing.LastModified.Equal(video.LastModified) {
+			video.Media = existing.Media
+		}
+
+		s.VideoStore.AddVideo(video)
+		found = append(found, video)
+		return nil
+	})
+	return found, errs
 }
 
-func generateThumbnail(videoPath, thumbnailPath string) error {
-	// Use ffmpeg to generate thumbnail from the middle of the video
-	cmd := exec.Command("ffmpeg",
-		"-i", videoPath,
-		"-ss", "00:00:01", // Take frame from 1 second in
-		"-vframes", "1",
-		"-vf", "scale=480:-1", // Scale width to 480px, maintain aspect ratio
-		"-f", "image2",
-		thumbnailPath,
-	)
-
-	return cmd.Run()
+func (s *VideoServer) serveWatchPage(w *Response, videoID string) {
+	video, exists := s.VideoStore.GetVideo(videoID)
+	if !exists {
+		s.writeError(w, 404, "Video Not Found")
+		s.Metrics.IncrementErrors()
+		return
+	}
+	video = s.probeVideo(video)
+	s.ensureTrickplay(video)
+
+	data := WatchTemplateData{
+		Title:        video.DisplayName,
+		VideoID:      video.VideoID,
+		Size:         video.Size,
+		LastModified: video.LastModified,
+		AudioTracks:  video.Media.AudioTracks,
+		DefaultAudio: video.Media.DefaultAudioTrack(),
+		Duration:     video.Media.Duration,
+	}
+
+	hasDefault := false
+	for _, track := range video.AllSubtitles() {
+		// Browsers only honour a single default track
+		isDefault := track.Default && !hasDefault
+		hasDefault = hasDefault || isDefault
+		data.Subtitles = append(data.Subtitles, WatchSubtitle{
+			ID:       track.ID,
+			Label:    track.Label,
+			Language: srclang(track.Language),
+			Default:  isDefault,
+		})
+	}
+
+	s.renderPage(w, "watch.html", data)
 }
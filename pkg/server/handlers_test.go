@@ -0,0 +1,136 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRange(t *testing.T) {
+	const size = 1000
+	tests := []struct {
+		header     string
+		start, end int64
+		partial    bool
+		bad        bool
+	}{
+		{header: ""},
+		{header: "items=0-10"},
+		{header: "bytes=0-10,20-30"},
+		{header: "bytes=0-99", start: 0, end: 99, partial: true},
+		{header: "bytes=500-", start: 500, end: 999, partial: true},
+		{header: "bytes=999-999", start: 999, end: 999, partial: true},
+		{header: "bytes=900-5000", start: 900, end: 999, partial: true},
+		{header: "bytes=-500", start: 500, end: 999, partial: true},
+		{header: "bytes=-5000", start: 0, end: 999, partial: true},
+		{header: "bytes=-1", start: 999, end: 999, partial: true},
+		{header: "bytes=500-100", bad: true},
+		{header: "bytes=1000-", bad: true},
+		{header: "bytes=1500-2000", bad: true},
+		{header: "bytes=-0", bad: true},
+		{header: "bytes=-", bad: true},
+		{header: "bytes=abc-def", bad: true},
+		{header: "bytes=+5-10", bad: true},
+		{header: "bytes=5", bad: true},
+	}
+
+	for _, tt := range tests {
+		start, end, partial, err := parseRange(tt.header, size)
+		if tt.bad {
+			if err == nil {
+				t.Errorf("parseRange(%q) = %d-%d, want error", tt.header, start, end)
+			}
+			continue
+		}
+		if err != nil || partial != tt.partial || partial && (start != tt.start || end != tt.end) {
+			t.Errorf("parseRange(%q) = %d, %d, %v, %v; want %d, %d, %v", tt.header, start, end, partial, err, tt.start, tt.end, tt.partial)
+		}
+	}
+
+	if _, _, _, err := parseRange("bytes=-10", 0); err == nil {
+		t.Error("suffix range of an empty file should be unsatisfiable")
+	}
+}
+
+func TestServeVideoRange(t *testing.T) {
+	s := newTestServer(t, nil)
+	id, data := addTestVideo(t, s, "range.mp4", 1000)
+	conn := dialTest(t, s)
+
+	tests := []struct {
+		header string
+		status int
+		want   []byte
+		cr     string
+	}{
+		{"", 200, data, ""},
+		{"Range: bytes=100-199", 206, data[100:200], "bytes 100-199/1000"},
+		{"Range: bytes=-100", 206, data[900:], "bytes 900-999/1000"},
+		{"Range: bytes=950-5000", 206, data[950:], "bytes 950-999/1000"},
+		{"Range: bytes=500-100", 416, nil, "bytes */1000"},
+		{"Range: bytes=1000-", 416, nil, "bytes */1000"},
+		// The connection must still be in step after the rejections
+		{"Range: bytes=0-0", 206, data[:1], "bytes 0-0/1000"},
+	}
+
+	// All requests share one kept-alive connection, so a wrong
+	// Content-Length shows up as a garbled later response
+	for _, tt := range tests {
+		var headers []string
+		if tt.header != "" {
+			headers = append(headers, tt.header)
+		}
+		resp := conn.get(t, "/videos/"+id, headers...)
+		got := body(t, resp)
+		if resp.StatusCode != tt.status {
+			t.Fatalf("%q: status %d, want %d", tt.header, resp.StatusCode, tt.status)
+		}
+		if cr := resp.Header.Get("Content-Range"); cr != tt.cr {
+			t.Errorf("%q: Content-Range %q, want %q", tt.header, cr, tt.cr)
+		}
+		if tt.want != nil && !bytes.Equal(got, tt.want) {
+			t.Errorf("%q: body of %d bytes does not match the file", tt.header, len(got))
+		}
+		if resp.ContentLength < 0 {
+			t.Errorf("%q: Content-Length %d", tt.header, resp.ContentLength)
+		}
+		if resp.Close {
+			t.Fatalf("%q: connection closed", tt.header)
+		}
+	}
+}
+
+func TestHeaderTimeout(t *testing.T) {
+	s := newTestServer(t, func(c *Config) {
+		c.HeaderTimeout = 100 * time.Millisecond
+		c.BanThreshold = 1
+	})
+
+	// A preconnect that never sends anything is closed without a response
+	// and without counting against the client
+	idle := dialTest(t, s)
+	if data, err := io.ReadAll(idle); err != nil || len(data) != 0 {
+		t.Errorf("silent connection got %q, %v; want it closed without a response", data, err)
+	}
+	if s.Guard.Banned() != 0 {
+		t.Fatal("silent connection counted as a violation")
+	}
+
+	// A request head that starts but does not finish is answered 408 and
+	// is a violation
+	slow := dialTest(t, s)
+	io.WriteString(slow, "GET / HTTP/1.1\r\nHost: test\r\n")
+	resp, err := http.ReadResponse(slow.reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body(t, resp)
+	if resp.StatusCode != 408 {
+		t.Errorf("unfinished request head: status %d, want 408", resp.StatusCode)
+	}
+	if s.Guard.Banned() != 1 {
+		t.Error("unfinished request head was not counted as a violation")
+	}
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Listeners are handed to a new process the way systemd socket activation
+// does it: as file descriptors from 3 on, counted by LISTEN_FDS. The
+// process that starts an upgrade also passes the write end of a pipe in
+// readyFDEnv, which the new process closes once it is serving.
+const (
+	listenFDStart = 3
+	readyFDEnv    = "GOCAST_READY_FD"
+)
+
+// inheritedListeners returns the listeners passed by systemd or by a
+// previous gocast process, if any. The variables are cleared so that
+// ffmpeg and later upgrades do not see them.
+func inheritedListeners() ([]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	count := os.Getenv("LISTEN_FDS")
+	if count == "" {
+		return nil, nil
+	}
+	// systemd names the process the sockets are meant for; gocast cannot
+	// know the PID of the process it starts and leaves it out
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", count)
+	}
+
+	var listeners []net.Listener
+	for fd := listenFDStart; fd < listenFDStart+n; fd++ {
+		file := os.NewFile(uintptr(fd), "listener-"+strconv.Itoa(fd))
+		l, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("inherited fd %d: %v", fd, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// notifyReady tells the process that started this one that it is serving
+func (s *VideoServer) notifyReady() {
+	value := os.Getenv(readyFDEnv)
+	if value == "" {
+		return
+	}
+	os.Unsetenv(readyFDEnv)
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		s.Logger.Warn("invalid ready pipe", "env", readyFDEnv, "value", value)
+		return
+	}
+	ready := os.NewFile(uintptr(fd), "ready")
+	ready.Write([]byte{1})
+	ready.Close()
+}
+
+// Upgrade starts a new copy of the running binary, with the same arguments,
+// serving on the same listening sockets. It returns once the new process is
+// accepting connections, after which the caller should Stop this one so
+// it drains. If the new process fails to start or exits first, this one
+// carries on serving and the error says why.
+func (s *VideoServer) Upgrade() error {
+	if !s.upgrading.CompareAndSwap(false, true) {
+		return errors.New("upgrade already in progress")
+	}
+	defer s.upgrading.Store(false)
+	if s.draining() {
+		return errors.New("server is shutting down")
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range s.Listeners {
+		filer, ok := l.Listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("listener %T cannot be passed on", l.Listener)
+		}
+		f, err := filer.File()
+		if err != nil {
+			return fmt.Errorf("failed to duplicate listener %s: %v", l.Config.name(), err)
+		}
+		files = append(files, f)
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create pipe: %v", err)
+	}
+	defer readyR.Close()
+
+	executable, err := os.Executable()
+	if err != nil {
+		readyW.Close()
+		return fmt.Errorf("failed to find executable: %v", err)
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Env = append(handoffEnv(),
+		"LISTEN_FDS="+strconv.Itoa(len(files)),
+		readyFDEnv+"="+strconv.Itoa(listenFDStart+len(files)),
+	)
+	err = cmd.Start()
+	// Only the child holds the write end now, so a read returns once it is
+	// ready or has exited
+	readyW.Close()
+	if err != nil {
+		return fmt.Errorf("failed to start %s: %v", executable, err)
+	}
+	s.Logger.Info("started new process", "pid", cmd.Process.Pid)
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	ready := make(chan bool, 1)
+	go func() {
+		n, _ := readyR.Read(make([]byte, 1))
+		ready <- n == 1
+	}()
+
+	select {
+	case ok := <-ready:
+		if ok {
+			// The new process serves on the same socket files now, so
+			// stopping this one must not remove them
+			for _, l := range s.Listeners {
+				if unix, ok := l.Listener.(*net.UnixListener); ok {
+					unix.SetUnlinkOnClose(false)
+				}
+			}
+			return nil
+		}
+		return fmt.Errorf("new process exited before serving: %v", <-exited)
+	case err := <-exited:
+		return fmt.Errorf("new process exited before serving: %v", err)
+	case <-time.After(s.Config.UpgradeTimeout):
+		cmd.Process.Kill()
+		return fmt.Errorf("new process not ready after %s", s.Config.UpgradeTimeout)
+	}
+}
+
+// handoffEnv is the environment for a new process, without any handoff
+// variables this one was started with
+func handoffEnv() []string {
+	var env []string
+	for _, v := range os.Environ() {
+		name, _, _ := strings.Cut(v, "=")
+		switch name {
+		case "LISTEN_FDS", "LISTEN_PID", "LISTEN_FDNAMES", readyFDEnv:
+			continue
+		}
+		env = append(env, v)
+	}
+	return env
+}
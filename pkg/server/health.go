@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Probe routes for orchestrators. They are answered before the per-request
+// rate limit, but a connection must still get past MaxConns and the guard's
+// bans and per-IP cap unless it is on a listener that only serves probes.
+var probePaths = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+	"/version": true,
+}
+
+// toolCheckInterval is how long an ffmpeg or ffprobe lookup is reused
+const toolCheckInterval = time.Minute
+
+// check is the result of one readiness check
+type check struct {
+	OK      bool   `json:"ok"`
+	Error   string `json:"error,omitempty"`
+	Version string `json:"version,omitempty"`
+	Videos  int    `json:"videos,omitempty"`
+}
+
+// toolVersions caches the result of running each external tool
+var toolVersions struct {
+	mu      sync.Mutex
+	checked map[string]time.Time
+	results map[string]check
+}
+
+// toolCheck reports whether an external tool runs, and its version
+func toolCheck(ctx context.Context, name string) check {
+	toolVersions.mu.Lock()
+	defer toolVersions.mu.Unlock()
+	if time.Since(toolVersions.checked[name]) < toolCheckInterval {
+		return toolVersions.results[name]
+	}
+
+	var result check
+	output, err := exec.CommandContext(ctx, name, "-version").Output()
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		// e.g. "ffmpeg version 6.1.1-3ubuntu5 Copyright (c) ..."
+		fields := strings.Fields(string(output))
+		if len(fields) >= 3 && fields[1] == "version" {
+			result.Version = fields[2]
+		}
+		result.OK = true
+	}
+
+	if toolVersions.checked == nil {
+		toolVersions.checked = make(map[string]time.Time)
+		toolVersions.results = make(map[string]check)
+	}
+	toolVersions.checked[name] = time.Now()
+	toolVersions.results[name] = result
+	return result
+}
+
+// handleProbe answers /healthz, /readyz and /version
+func (s *VideoServer) handleProbe(w *Response, path string) {
+	switch path {
+	case "/healthz":
+		// The process is up and able to answer; nothing else is checked
+		s.writeJSON(w, 200, map[string]any{
+			"status": "ok",
+			"uptime": time.Since(s.startedAt).Seconds(),
+		})
+	case "/readyz":
+		checks, ready := s.readiness()
+		status, code := "ready", 200
+		if !ready {
+			status, code = "not ready", 503
+		}
+		s.writeJSON(w, code, map[string]any{
+			"status": status,
+			"checks": checks,
+		})
+	case "/version":
+		s.writeJSON(w, 200, buildInfo())
+	}
+}
+
+// readiness runs the checks behind /readyz
+func (s *VideoServer) readiness() (map[string]check, bool) {
+	checks := map[string]check{
+		"listener": {OK: len(s.Listeners) > 0 && !s.draining()},
+		"videoDir": {OK: true},
+		"ffmpeg":   toolCheck(s.Ctx, "ffmpeg"),
+		"ffprobe":  toolCheck(s.Ctx, "ffprobe"),
+		"index":    {OK: s.indexLoaded.Load(), Videos: len(s.VideoStore.GetAllVideos())},
+	}
+
+	if dir, err := os.Open(s.Config.VideoDir); err != nil {
+		checks["videoDir"] = check{Error: err.Error()}
+	} else {
+		if _, err := dir.Readdirnames(1); err != nil && err != io.EOF {
+			checks["videoDir"] = check{Error: err.Error()}
+		}
+		dir.Close()
+	}
+
+	ready := true
+	for _, c := range checks {
+		ready = ready && c.OK
+	}
+	return checks, ready
+}
+
+// buildInfo describes the running binary from the information the Go
+// toolchain embeds in it
+func buildInfo() map[string]string {
+	info := map[string]string{"version": "unknown"}
+	build, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+
+	info["version"] = build.Main.Version
+	info["path"] = build.Main.Path
+	info["goVersion"] = build.GoVersion
+	for _, setting := range build.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			info["revision"] = setting.Value
+		case "vcs.time":
+			info["buildTime"] = setting.Value
+		case "vcs.modified":
+			info["modified"] = setting.Value
+		}
+	}
+	return info
+}
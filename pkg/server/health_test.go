@@ -0,0 +1,37 @@
+package server
+
+import (
+	"io"
+	"testing"
+)
+
+func TestProbeListenerSkipsGuard(t *testing.T) {
+	s := newTestServer(t, func(c *Config) {
+		c.Listeners = []ListenerConfig{
+			{Address: "127.0.0.1:0", Routes: []string{RoutesPublic, RoutesHealth}},
+			{Address: "127.0.0.1:0", Routes: []string{RoutesHealth}},
+		}
+		c.BanThreshold = 1
+	})
+	shared, probes := s.Listeners[0].Addr().String(), s.Listeners[1].Addr().String()
+
+	s.Guard.Violation("127.0.0.1")
+	if s.Guard.Banned() != 1 {
+		t.Fatal("client not banned")
+	}
+
+	// A banned client is dropped before its request is read, probe or not
+	conn := dialAddr(t, shared)
+	io.WriteString(conn, "GET /healthz HTTP/1.1\r\nHost: test\r\n\r\n")
+	if n, _ := conn.Read(make([]byte, 1)); n != 0 {
+		t.Error("banned client answered on the shared listener")
+	}
+
+	for _, path := range []string{"/healthz", "/version"} {
+		resp := dialAddr(t, probes).get(t, path)
+		body(t, resp)
+		if resp.StatusCode != 200 {
+			t.Errorf("%s on the probe listener: status %d", path, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"ren.local/gocast/pkg/models"
+)
+
+// indexVersion changes whenever the saved format does
+const indexVersion = 1
+
+// libraryIndex is the on-disk form of the video store, so probed stream
+// info survives restarts and `gocast scan` can index a library offline
+type libraryIndex struct {
+	Version int                `json:"version"`
+	SavedAt time.Time          `json:"savedAt"`
+	Videos  []models.VideoFile `json:"videos"`
+}
+
+// LoadIndex fills the video store from IndexPath. Entries whose file has
+// since changed or disappeared are skipped; the next scan picks them up.
+func (s *VideoServer) LoadIndex() error {
+	if s.Config.IndexPath == "" {
+		return nil
+	}
+	data, err := os.ReadFile(s.Config.IndexPath)
+	if err != nil {
+		return err
+	}
+
+	var index libraryIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return fmt.Errorf("failed to decode index: %v", err)
+	}
+	if index.Version != indexVersion {
+		return fmt.Errorf("index version %d is not supported", index.Version)
+	}
+
+	for _, video := range index.Videos {
+		info, err := os.Stat(filepath.Join(s.Config.VideoDir, video.Name))
+		if err != nil || info.Size() != video.Size || !info.ModTime().Equal(video.LastModified) {
+			continue
+		}
+		s.VideoStore.AddVideo(video)
+	}
+	return nil
+}
+
+// SaveIndex writes the video store to IndexPath. The file is replaced
+// atomically so a crash mid-write leaves the previous index intact.
+func (s *VideoServer) SaveIndex() error {
+	if s.Config.IndexPath == "" {
+		return nil
+	}
+	data, err := json.Marshal(libraryIndex{
+		Version: indexVersion,
+		SavedAt: time.Now(),
+		Videos:  s.VideoStore.GetAllVideos(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode index: %v", err)
+	}
+
+	tmpPath := s.Config.IndexPath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write index: %v", err)
+	}
+	if err := os.Rename(tmpPath, s.Config.IndexPath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write index: %v", err)
+	}
+	return nil
+}
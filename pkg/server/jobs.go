@@ -0,0 +1,270 @@
+package server
+
+import (
+	"container/heap"
+	"context"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Job priorities; higher values run first
+const (
+	PriorityLow  = 0
+	PriorityHigh = 10
+)
+
+// Job states reported by JobQueue.Status
+const (
+	JobNone     = ""
+	JobPending  = "pending"
+	JobRunning  = "running"
+	JobRetrying = "retrying" // Pending again, waiting out the backoff after a failure
+	JobFailed   = "failed"
+)
+
+type job struct {
+	key      string
+	priority int
+	seq      uint64
+	run      func() error
+	attempts int
+	state    string
+	failedAt time.Time
+	index    int
+}
+
+// reportedState is the job's state as shown to callers. Internally a job in
+// backoff stays pending, out of the heap, so Enqueue still deduplicates it.
+func (j *job) reportedState() string {
+	if j.state == JobPending && j.index < 0 {
+		return JobRetrying
+	}
+	return j.state
+}
+
+// jobHeap orders jobs by priority, then by submission order
+type jobHeap []*job
+
+func (h jobHeap) Len() int { return len(h) }
+func (h jobHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+func (h jobHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *jobHeap) Push(x any) {
+	j := x.(*job)
+	j.index = len(*h)
+	*h = append(*h, j)
+}
+func (h *jobHeap) Pop() any {
+	old := *h
+	j := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	j.index = -1
+	return j
+}
+
+// JobQueue runs background work such as thumbnail generation on a fixed
+// number of workers. Jobs are deduplicated by key, so asking for the same
+// thumbnail twice while it is queued or running does nothing, and failed
+// jobs are retried with exponential backoff.
+type JobQueue struct {
+	mu         sync.Mutex
+	cond       *sync.Cond
+	pending    jobHeap
+	jobs       map[string]*job
+	seq        uint64
+	maxRetries int
+	backoff    time.Duration
+	wg         sync.WaitGroup
+	completed  int64
+	failed     int64
+	logger     *slog.Logger
+}
+
+// NewJobQueue creates a queue that logs failures to logger; call Start to
+// launch its workers
+func NewJobQueue(maxRetries int, backoff time.Duration, logger *slog.Logger) *JobQueue {
+	q := &JobQueue{
+		jobs:       make(map[string]*job),
+		maxRetries: maxRetries,
+		backoff:    backoff,
+		logger:     logger,
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// Start launches workers that run until ctx is cancelled
+func (q *JobQueue) Start(ctx context.Context, workers int) {
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.worker(ctx)
+	}
+
+	// Wake idle workers so they notice cancellation
+	go func() {
+		<-ctx.Done()
+		q.mu.Lock()
+		q.cond.Broadcast()
+		q.mu.Unlock()
+	}()
+}
+
+// Wait blocks until all workers have exited
+func (q *JobQueue) Wait() {
+	q.wg.Wait()
+}
+
+// Enqueue schedules fn under key. If the key is already queued its priority
+// is raised if needed; if it is running or backing off the call is a no-op.
+// Keys that exhausted their retries are accepted again after a cooldown.
+func (q *JobQueue) Enqueue(key string, priority int, fn func() error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if existing, ok := q.jobs[key]; ok {
+		switch existing.state {
+		case JobPending:
+			if priority > existing.priority {
+				existing.priority = priority
+				if existing.index >= 0 {
+					heap.Fix(&q.pending, existing.index)
+				}
+			}
+			return
+		case JobRunning:
+			return
+		case JobFailed:
+			if time.Since(existing.failedAt) < q.cooldown() {
+				return
+			}
+		}
+	}
+
+	q.seq++
+	j := &job{key: key, priority: priority, seq: q.seq, run: fn, state: JobPending}
+	q.jobs[key] = j
+	heap.Push(&q.pending, j)
+	q.cond.Signal()
+}
+
+// Status reports the state of the job with the given key
+func (q *JobQueue) Status(key string) string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if j, ok := q.jobs[key]; ok {
+		return j.reportedState()
+	}
+	return JobNone
+}
+
+// Stats returns queue counters for monitoring
+func (q *JobQueue) Stats() map[string]int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	stats := map[string]int64{
+		"queued":    int64(len(q.pending)),
+		"running":   0,
+		"retrying":  0,
+		"completed": q.completed,
+		"failed":    q.failed,
+	}
+	for _, j := range q.jobs {
+		switch j.reportedState() {
+		case JobRunning:
+			stats["running"]++
+		case JobRetrying:
+			stats["retrying"]++
+		}
+	}
+	return stats
+}
+
+// JobInfo describes a queued, running or failed job
+type JobInfo struct {
+	Key      string `json:"key"`
+	State    string `json:"state"`
+	Attempts int    `json:"attempts"`
+}
+
+// List returns the jobs the queue knows about, running ones first
+func (q *JobQueue) List() []JobInfo {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	jobs := make([]JobInfo, 0, len(q.jobs))
+	for _, j := range q.jobs {
+		jobs = append(jobs, JobInfo{Key: j.key, State: j.reportedState(), Attempts: j.attempts})
+	}
+	order := map[string]int{JobRunning: 0, JobPending: 1, JobRetrying: 2, JobFailed: 3}
+	sort.Slice(jobs, func(a, b int) bool {
+		if order[jobs[a].State] != order[jobs[b].State] {
+			return order[jobs[a].State] < order[jobs[b].State]
+		}
+		return jobs[a].Key < jobs[b].Key
+	})
+	return jobs
+}
+
+func (q *JobQueue) cooldown() time.Duration {
+	return q.backoff << q.maxRetries
+}
+
+func (q *JobQueue) worker(ctx context.Context) {
+	defer q.wg.Done()
+
+	for {
+		q.mu.Lock()
+		for len(q.pending) == 0 && ctx.Err() == nil {
+			q.cond.Wait()
+		}
+		if ctx.Err() != nil {
+			q.mu.Unlock()
+			return
+		}
+		j := heap.Pop(&q.pending).(*job)
+		j.state = JobRunning
+		j.attempts++
+		q.mu.Unlock()
+
+		err := j.run()
+
+		q.mu.Lock()
+		switch {
+		case err == nil:
+			delete(q.jobs, j.key)
+			q.completed++
+		case j.attempts > q.maxRetries:
+			q.logger.Error("job failed", "error", err, "job", j.key, "attempts", j.attempts)
+			j.state = JobFailed
+			j.failedAt = time.Now()
+			q.failed++
+		default:
+			// Stay pending (and deduplicated) while backing off
+			delay := q.backoff << (j.attempts - 1)
+			q.logger.Warn("job failed, retrying", "error", err, "job", j.key, "attempts", j.attempts, "retry_in", delay)
+			j.state = JobPending
+			j.index = -1
+			time.AfterFunc(delay, func() {
+				q.mu.Lock()
+				defer q.mu.Unlock()
+				if ctx.Err() == nil && j.state == JobPending && j.index < 0 {
+					heap.Push(&q.pending, j)
+					q.cond.Signal()
+				}
+			})
+		}
+		q.mu.Unlock()
+	}
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestJobQueueCountsRetryingJobs(t *testing.T) {
+	q := NewJobQueue(2, 200*time.Millisecond, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		q.Wait()
+	}()
+	q.Start(ctx, 1)
+
+	var attempts atomic.Int32
+	q.Enqueue("flaky", PriorityLow, func() error {
+		if attempts.Add(1) == 1 {
+			return fmt.Errorf("first attempt fails")
+		}
+		return nil
+	})
+
+	// After the first failure the job waits out its backoff, neither in
+	// the heap nor running
+	for deadline := time.Now().Add(time.Second); attempts.Load() == 0 && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	stats := q.Stats()
+	if stats["retrying"] != 1 || stats["queued"] != 0 || stats["running"] != 0 {
+		t.Errorf("during backoff: stats %v, want one retrying job", stats)
+	}
+	if state := q.Status("flaky"); state != JobRetrying {
+		t.Errorf("during backoff: status %q, want %q", state, JobRetrying)
+	}
+	if list := q.List(); len(list) != 1 || list[0].State != JobRetrying {
+		t.Errorf("during backoff: list %v", list)
+	}
+
+	for deadline := time.Now().Add(2 * time.Second); q.Stats()["completed"] == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := q.Stats(); stats["completed"] != 1 || stats["retrying"] != 0 || stats["failed"] != 0 {
+		t.Errorf("after the retry: stats %v", stats)
+	}
+}
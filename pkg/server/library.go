@@ -0,0 +1,107 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"ren.local/gocast/pkg/models"
+)
+
+// Library operations used by the gocast subcommands. They run without
+// Start, against the same store, config and ffmpeg helpers as the server.
+
+// Scan indexes VideoDir, probing every video not already probed, and saves
+// the index. Problems are returned alongside the videos rather than ending
+// the scan.
+func (s *VideoServer) Scan() ([]models.VideoFile, []error) {
+	videos, errs := s.walkLibrary()
+	for i, video := range videos {
+		if video.Media != nil {
+			continue
+		}
+		result, err := probeFile(s.Ctx, filepath.Join(s.Config.VideoDir, video.Name))
+		if err != nil {
+			// Left unprobed so the server tries again when it is played
+			errs = append(errs, fmt.Errorf("%s: %v", video.Name, err))
+			continue
+		}
+		video.Media = result.mediaInfo()
+		s.VideoStore.AddVideo(video)
+		videos[i] = video
+	}
+
+	if err := s.SaveIndex(); err != nil {
+		errs = append(errs, err)
+	}
+	return videos, errs
+}
+
+// GenerateThumbnails builds thumbnails for videos in turn, skipping those
+// that are up to date unless regenerate is set. report is called for each
+// video processed.
+func (s *VideoServer) GenerateThumbnails(videos []models.VideoFile, regenerate bool, report func(models.VideoFile, error)) {
+	for _, video := range videos {
+		if !regenerate && !s.thumbnailStale(video) {
+			continue
+		}
+		report(video, s.generateThumbnail(video))
+	}
+}
+
+// ProbeFile returns the stream information ffprobe finds in a media file
+func ProbeFile(path string) (*models.MediaInfo, error) {
+	result, err := probeFile(context.Background(), path)
+	if err != nil {
+		return nil, err
+	}
+	return result.mediaInfo(), nil
+}
+
+// Verify checks that a video can be read to the end and that ffprobe finds
+// a playable video stream in it. With deep set the whole file is also
+// decoded, which catches damage in the middle of a stream but takes about
+// as long as the video's own encoding did.
+func (s *VideoServer) Verify(video models.VideoFile, deep bool) error {
+	path := filepath.Join(s.Config.VideoDir, video.Name)
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(io.Discard, file)
+	file.Close()
+	if err != nil {
+		return fmt.Errorf("read error after %d bytes: %v", n, err)
+	}
+
+	result, err := probeFile(s.Ctx, path)
+	if err != nil {
+		return err
+	}
+	media := result.mediaInfo()
+	if media.Width == 0 {
+		return fmt.Errorf("no video stream")
+	}
+	if media.Duration <= 0 {
+		return fmt.Errorf("unknown duration")
+	}
+
+	if deep {
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(s.Ctx, "ffmpeg", "-v", "error", "-xerror", "-i", path, "-f", "null", "-")
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			if msg := strings.TrimSpace(stderr.String()); msg != "" {
+				return fmt.Errorf("decode error: %s", msg)
+			}
+			return fmt.Errorf("decode error: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Route groups a listener can serve
+const (
+	RoutesPublic = "public" // Library, player, media and static files
+	RoutesAdmin  = "admin"  // /admin pages and API
+	RoutesHealth = "health" // /healthz, /readyz and /version
+)
+
+// maxProbeConns caps the connections open at once on a listener that only
+// serves probes, in place of MaxConns
+const maxProbeConns = 16
+
+// ListenerConfig describes one address the server accepts connections on
+type ListenerConfig struct {
+	Name    string      // Shown in logs and stats, defaults to the address
+	Network string      // tcp (the default), tcp4, tcp6 or unix
+	Address string      // host:port, or the socket path for unix
+	Routes  []string    // Route groups served, empty for all
+	Allow   []string    // CIDRs allowed to connect, empty for any; not checked on unix sockets
+	Mode    os.FileMode // Permissions of a unix socket, default 0660
+}
+
+// Listener is an open ListenerConfig and its counters
+type Listener struct {
+	net.Listener
+	Config ListenerConfig
+	slots  chan struct{} // Held by each open connection, shared with the server unless probesOnly
+
+	active   atomic.Int64
+	accepted atomic.Int64
+	rejected atomic.Int64
+	requests atomic.Int64
+	bytes    atomic.Int64
+}
+
+// ListenerInfo is a snapshot of a listener for /admin/stats and the dashboard
+type ListenerInfo struct {
+	Name     string   `json:"name"`
+	Network  string   `json:"network"`
+	Address  string   `json:"address"`
+	Routes   []string `json:"routes"`
+	Active   int64    `json:"activeConnections"`
+	Accepted int64    `json:"acceptedConnections"`
+	Rejected int64    `json:"rejectedConnections"` // Turned away by Allow or the guard
+	Requests int64    `json:"requestCount"`
+	Bytes    int64    `json:"bytesTransferred"`
+}
+
+// Info returns the listener's counters
+func (l *Listener) Info() ListenerInfo {
+	routes := l.Config.Routes
+	if len(routes) == 0 {
+		routes = []string{RoutesPublic, RoutesAdmin, RoutesHealth}
+	}
+	return ListenerInfo{
+		Name:     l.Config.name(),
+		Network:  l.Config.network(),
+		Address:  l.Addr().String(),
+		Routes:   routes,
+		Active:   l.active.Load(),
+		Accepted: l.accepted.Load(),
+		Rejected: l.rejected.Load(),
+		Requests: l.requests.Load(),
+		Bytes:    l.bytes.Load(),
+	}
+}
+
+// listenerStats returns the counters of every listener
+func (s *VideoServer) listenerStats() []ListenerInfo {
+	stats := make([]ListenerInfo, 0, len(s.Listeners))
+	for _, l := range s.Listeners {
+		stats = append(stats, l.Info())
+	}
+	return stats
+}
+
+// serves reports whether requests for a route group are answered here
+func (l *Listener) serves(group string) bool {
+	if len(l.Config.Routes) == 0 {
+		return true
+	}
+	for _, r := range l.Config.Routes {
+		if r == group {
+			return true
+		}
+	}
+	return false
+}
+
+// probesOnly reports whether the listener serves nothing but probes. Its
+// connections skip the guard and the server's connection limit, so an
+// orchestrator can reach it while clients are banned or the server is full.
+func (l *Listener) probesOnly() bool {
+	if len(l.Config.Routes) == 0 {
+		return false
+	}
+	for _, r := range l.Config.Routes {
+		if r != RoutesHealth {
+			return false
+		}
+	}
+	return true
+}
+
+// allows reports whether a peer may connect to the listener
+func (l *Listener) allows(ip string) bool {
+	if len(l.Config.Allow) == 0 || l.Config.network() == "unix" {
+		return true
+	}
+	return inNetworks(net.ParseIP(ip), l.Config.Allow)
+}
+
+// routeGroup returns the group a request path belongs to
+func routeGroup(path string) string {
+	switch {
+	case probePaths[path]:
+		return RoutesHealth
+	case path == "/admin" || strings.HasPrefix(path, "/admin/"):
+		return RoutesAdmin
+	default:
+		return RoutesPublic
+	}
+}
+
+func (c ListenerConfig) name() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	if c.network() == "unix" {
+		return "unix:" + c.Address
+	}
+	return c.Address
+}
+
+func (c ListenerConfig) network() string {
+	if c.Network == "" {
+		return "tcp"
+	}
+	return c.Network
+}
+
+// ParseListener reads a listener from the command line form
+// [routes@]address, where routes is a comma-separated list of route groups
+// and address is host:port, tcp4:host:port, tcp6:host:port or unix:path
+func ParseListener(spec string) (ListenerConfig, error) {
+	var c ListenerConfig
+	if routes, address, ok := strings.Cut(spec, "@"); ok {
+		for _, r := range strings.Split(routes, ",") {
+			switch r {
+			case RoutesPublic, RoutesAdmin, RoutesHealth:
+				c.Routes = append(c.Routes, r)
+			default:
+				return c, fmt.Errorf("unknown route group %q in %q", r, spec)
+			}
+		}
+		spec = address
+	}
+	c.Address = spec
+	for _, network := range []string{"tcp4", "tcp6", "unix"} {
+		if address, ok := strings.CutPrefix(spec, network+":"); ok {
+			c.Network, c.Address = network, address
+		}
+	}
+	if c.Address == "" {
+		return c, fmt.Errorf("missing address in %q", spec)
+	}
+	return c, nil
+}
+
+// listenerConfigs returns Config.Listeners, or a single listener serving
+// everything on Config.Port if none are set
+func (s *VideoServer) listenerConfigs() []ListenerConfig {
+	if len(s.Config.Listeners) > 0 {
+		return s.Config.Listeners
+	}
+	return []ListenerConfig{{Address: s.Config.Port}}
+}
+
+// openListeners opens every configured listener, adopting a matching one
+// passed by systemd or the process being upgraded where there is one so no
+// connection is refused while gocast restarts
+func (s *VideoServer) openListeners() error {
+	// Sockets from systemd belong to it, but ones from an upgrade are this
+	// process's to remove when it stops
+	upgraded := os.Getenv(readyFDEnv) != ""
+	inherited, err := inheritedListeners()
+	if err != nil {
+		return err
+	}
+	configs := s.listenerConfigs()
+
+	for i, c := range configs {
+		var l net.Listener
+		for j, in := range inherited {
+			// A lone inherited socket serves a lone listener whatever its
+			// address, as systemd decides where it listens
+			if in != nil && (sameAddr(c, in.Addr()) || (len(configs) == 1 && len(inherited) == 1)) {
+				l, inherited[j] = in, nil
+				break
+			}
+		}
+		if l != nil {
+			s.Logger.Info("adopted inherited listener", "address", l.Addr().String())
+			if unix, ok := l.(*net.UnixListener); ok && upgraded {
+				unix.SetUnlinkOnClose(true)
+			}
+		} else if l, err = listen(c); err != nil {
+			for _, open := range s.Listeners {
+				open.Close()
+			}
+			s.Listeners = nil
+			return fmt.Errorf("listener %s: %v", c.name(), err)
+		}
+		listener := &Listener{Listener: l, Config: configs[i], slots: s.ConnLimit}
+		if listener.probesOnly() {
+			listener.slots = make(chan struct{}, maxProbeConns)
+		}
+		s.Listeners = append(s.Listeners, listener)
+	}
+
+	for _, in := range inherited {
+		if in != nil {
+			s.Logger.Info("closing unused inherited listener", "address", in.Addr().String())
+			in.Close()
+		}
+	}
+	return nil
+}
+
+// listen opens a listener. A unix socket left behind by a process that did
+// not shut down cleanly is replaced.
+func listen(c ListenerConfig) (net.Listener, error) {
+	if c.network() != "unix" {
+		return net.Listen(c.network(), c.Address)
+	}
+
+	if info, err := os.Lstat(c.Address); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", c.Address); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use", c.Address)
+		}
+		os.Remove(c.Address)
+	}
+	l, err := net.Listen("unix", c.Address)
+	if err != nil {
+		return nil, err
+	}
+	mode := c.Mode
+	if mode == 0 {
+		mode = 0660
+	}
+	if err := os.Chmod(c.Address, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// sameAddr reports whether an inherited listener's address is the one a
+// listener is configured for
+func sameAddr(c ListenerConfig, addr net.Addr) bool {
+	if c.network() == "unix" {
+		return addr.Network() == "unix" && addr.String() == c.Address
+	}
+	want, err := net.ResolveTCPAddr(c.network(), c.Address)
+	got, ok := addr.(*net.TCPAddr)
+	if err != nil || !ok || want.Port != got.Port {
+		return false
+	}
+	unspecified := func(ip net.IP) bool { return ip == nil || ip.IsUnspecified() }
+	return want.IP.Equal(got.IP) || unspecified(want.IP) && unspecified(got.IP)
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseListener(t *testing.T) {
+	tests := []struct {
+		spec string
+		want ListenerConfig
+		bad  bool
+	}{
+		{spec: ":4221", want: ListenerConfig{Address: ":4221"}},
+		{spec: "127.0.0.1:4222", want: ListenerConfig{Address: "127.0.0.1:4222"}},
+		{spec: "[::1]:4221", want: ListenerConfig{Address: "[::1]:4221"}},
+		{spec: "tcp4::4221", want: ListenerConfig{Network: "tcp4", Address: ":4221"}},
+		{spec: "tcp6:[::]:4221", want: ListenerConfig{Network: "tcp6", Address: "[::]:4221"}},
+		{spec: "unix:/run/gocast/gocast.sock", want: ListenerConfig{Network: "unix", Address: "/run/gocast/gocast.sock"}},
+		{spec: "health@:4223", want: ListenerConfig{Address: ":4223", Routes: []string{RoutesHealth}}},
+		{spec: "admin,health@127.0.0.1:4222", want: ListenerConfig{Address: "127.0.0.1:4222", Routes: []string{RoutesAdmin, RoutesHealth}}},
+		{spec: "public,health@unix:/run/gocast.sock", want: ListenerConfig{Network: "unix", Address: "/run/gocast.sock", Routes: []string{RoutesPublic, RoutesHealth}}},
+		{spec: "", bad: true},
+		{spec: "unix:", bad: true},
+		{spec: "public@", bad: true},
+		{spec: "@:4221", bad: true},
+		{spec: "media@:4221", bad: true},
+		{spec: "public,,admin@:4221", bad: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseListener(tt.spec)
+		if tt.bad {
+			if err == nil {
+				t.Errorf("ParseListener(%q) = %+v, want error", tt.spec, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseListener(%q) = %+v, %v; want %+v", tt.spec, got, err, tt.want)
+		}
+	}
+}
+
+func TestSameAddr(t *testing.T) {
+	tcp := func(ip string, port int) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: port}
+	}
+	tests := []struct {
+		config ListenerConfig
+		addr   net.Addr
+		want   bool
+	}{
+		{ListenerConfig{Address: "127.0.0.1:4221"}, tcp("127.0.0.1", 4221), true},
+		{ListenerConfig{Address: "127.0.0.1:4221"}, tcp("127.0.0.1", 4222), false},
+		{ListenerConfig{Address: "127.0.0.1:4221"}, tcp("10.0.0.1", 4221), false},
+		{ListenerConfig{Address: ":4221"}, tcp("::", 4221), true},
+		{ListenerConfig{Address: ":4221"}, tcp("0.0.0.0", 4221), true},
+		{ListenerConfig{Address: "0.0.0.0:4221"}, tcp("::", 4221), true},
+		{ListenerConfig{Address: ":4221"}, tcp("127.0.0.1", 4221), false},
+		{ListenerConfig{Network: "tcp6", Address: "[::1]:4221"}, tcp("::1", 4221), true},
+		{ListenerConfig{Address: ":4221"}, &net.UnixAddr{Name: ":4221", Net: "unix"}, false},
+		{ListenerConfig{Network: "unix", Address: "/run/gocast.sock"}, &net.UnixAddr{Name: "/run/gocast.sock", Net: "unix"}, true},
+		{ListenerConfig{Network: "unix", Address: "/run/gocast.sock"}, &net.UnixAddr{Name: "/run/other.sock", Net: "unix"}, false},
+		{ListenerConfig{Network: "unix", Address: "/run/gocast.sock"}, tcp("127.0.0.1", 4221), false},
+		{ListenerConfig{Address: "not an address"}, tcp("127.0.0.1", 4221), false},
+	}
+
+	for _, tt := range tests {
+		if got := sameAddr(tt.config, tt.addr); got != tt.want {
+			t.Errorf("sameAddr(%s %q, %s) = %v, want %v", tt.config.network(), tt.config.Address, tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestListenerGating(t *testing.T) {
+	tests := []struct {
+		config     ListenerConfig
+		public     bool
+		admin      bool
+		health     bool
+		probesOnly bool
+	}{
+		{ListenerConfig{}, true, true, true, false},
+		{ListenerConfig{Routes: []string{RoutesPublic}}, true, false, false, false},
+		{ListenerConfig{Routes: []string{RoutesAdmin, RoutesHealth}}, false, true, true, false},
+		{ListenerConfig{Routes: []string{RoutesHealth}}, false, false, true, true},
+	}
+	for _, tt := range tests {
+		l := &Listener{Config: tt.config}
+		for path, want := range map[string]bool{
+			"/":                tt.public,
+			"/videos/abc":      tt.public,
+			"/administrator":   tt.public,
+			"/admin":           tt.admin,
+			"/admin/stats":     tt.admin,
+			"/healthz":         tt.health,
+			"/readyz":          tt.health,
+			"/version":         tt.health,
+			"/healthz/details": tt.public,
+		} {
+			if got := l.serves(routeGroup(path)); got != want {
+				t.Errorf("routes %v: serves %s = %v, want %v", tt.config.Routes, path, got, want)
+			}
+		}
+		if got := l.probesOnly(); got != tt.probesOnly {
+			t.Errorf("routes %v: probesOnly = %v, want %v", tt.config.Routes, got, tt.probesOnly)
+		}
+	}
+
+	allowTests := []struct {
+		config ListenerConfig
+		ip     string
+		want   bool
+	}{
+		{ListenerConfig{}, "203.0.113.7", true},
+		{ListenerConfig{Allow: []string{"10.0.0.0/8", "::1/128"}}, "10.1.2.3", true},
+		{ListenerConfig{Allow: []string{"10.0.0.0/8", "::1/128"}}, "::1", true},
+		{ListenerConfig{Allow: []string{"10.0.0.0/8", "::1/128"}}, "203.0.113.7", false},
+		{ListenerConfig{Allow: []string{"10.0.0.0/8"}}, "not an address", false},
+		{ListenerConfig{Network: "unix", Allow: []string{"10.0.0.0/8"}}, "127.0.0.1", true},
+	}
+	for _, tt := range allowTests {
+		l := &Listener{Config: tt.config}
+		if got := l.allows(tt.ip); got != tt.want {
+			t.Errorf("allow %v on %s: allows(%s) = %v, want %v", tt.config.Allow, tt.config.network(), tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestListenerRoutes(t *testing.T) {
+	s := newTestServer(t, func(c *Config) {
+		c.Listeners = []ListenerConfig{
+			{Address: "127.0.0.1:0", Routes: []string{RoutesPublic}},
+			{Address: "127.0.0.1:0", Routes: []string{RoutesAdmin, RoutesHealth}},
+			{Address: "127.0.0.1:0", Allow: []string{"10.0.0.0/8"}},
+		}
+	})
+	public, admin, allowed := s.Listeners[0].Addr().String(), s.Listeners[1].Addr().String(), s.Listeners[2].Addr().String()
+
+	tests := []struct {
+		addr   string
+		path   string
+		status int
+	}{
+		{public, "/", 200},
+		{public, "/admin", 404},
+		{public, "/healthz", 404},
+		{admin, "/", 404},
+		{admin, "/admin/stats", 200},
+		{admin, "/healthz", 200},
+	}
+	for _, tt := range tests {
+		resp := dialAddr(t, tt.addr).get(t, tt.path)
+		body(t, resp)
+		if resp.StatusCode != tt.status {
+			t.Errorf("GET %s on %s: status %d, want %d", tt.path, tt.addr, resp.StatusCode, tt.status)
+		}
+	}
+
+	// A peer outside Allow is disconnected before its request is read
+	conn := dialAddr(t, allowed)
+	if _, err := conn.Write([]byte("GET /healthz HTTP/1.1\r\nHost: test\r\n\r\n")); err == nil {
+		if n, _ := conn.Read(make([]byte, 1)); n != 0 {
+			t.Error("peer outside Allow was answered")
+		}
+	}
+	if info := s.Listeners[2].Info(); info.Rejected != 1 || info.Accepted != 0 {
+		t.Errorf("listener counted %d accepted, %d rejected; want 0 and 1", info.Accepted, info.Rejected)
+	}
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"time"
+
+	"ren.local/gocast/pkg/models"
+	"ren.local/gocast/pkg/templates"
+)
+
+// The types below are the data contract for the page templates. Custom
+// templates in Config.TemplateDir receive exactly these values, so fields
+// are only ever added, never renamed or removed.
+
+// ListTemplateData is passed to video_list.html
+type ListTemplateData struct {
+	Videos          []models.VideoFile // Every video in the library; use .VideoID, .DisplayName, .Size and .LastModified
+	Pending         map[string]bool    // Video IDs whose thumbnail is still being generated
+	ThumbnailWidths []int              // Widths offered by /thumbnails/{id}?w=, for srcset
+}
+
+// WatchTemplateData is passed to watch.html
+type WatchTemplateData struct {
+	Title        string
+	VideoID      string
+	Size         int64
+	LastModified time.Time
+	Subtitles    []WatchSubtitle
+	AudioTracks  []models.AudioTrack // Empty if the file could not be probed
+	DefaultAudio int                 // Index of the track the browser plays from the raw file
+	Duration     float64             // Seconds, 0 if unknown
+}
+
+// WatchSubtitle describes a <track> element on the watch page
+type WatchSubtitle struct {
+	ID       string // Served at /subtitles/{VideoID}/{ID}.vtt
+	Label    string
+	Language string
+	Default  bool // Set on at most one track
+}
+
+// AdminTemplateData is passed to admin.html. It is also the payload of each
+// event on /admin/events, which the page uses to update itself.
+type AdminTemplateData struct {
+	Connections []AdminConnection `json:"connections"`
+	Metrics     map[string]int64  `json:"metrics"` // Metrics.GetStats
+	Cache       map[string]int64  `json:"cache"`   // Block cache occupancy
+	Jobs        map[string]int64  `json:"jobs"`    // Queue counters
+	JobList     []JobInfo         `json:"jobList"`
+	Listeners   []ListenerInfo    `json:"listeners"`
+	Limits      Limits            `json:"limits"`
+	Videos      int               `json:"videos"`
+}
+
+// AdminConnection describes a client connection on the dashboard
+type AdminConnection struct {
+	models.ConnectionInfo
+	Title string `json:"title"` // Display name of the video being served, if any
+	Size  int64  `json:"size"`  // Size of that video, for showing Position as progress
+}
+
+// templateFuncs are available to every template, built-in or custom
+func (s *VideoServer) templateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"BytesToHuman": func(b int64) string {
+			const unit = 1024
+			if b < unit {
+				return fmt.Sprintf("%d B", b)
+			}
+			div, exp := int64(unit), 0
+			for n := b / unit; n >= unit; n /= unit {
+				div *= unit
+				exp++
+			}
+			return fmt.Sprintf("%.1f %cB", float64(b)/float64(div), "KMGTPE"[exp])
+		},
+		// base prefixes every URL in the templates
+		"base": func() string {
+			return s.Config.BasePath
+		},
+		// asset returns the content-hashed URL of a file in static/
+		"asset": func(name string) string {
+			return s.Static.URL(s.Config.BasePath, name)
+		},
+		"FormatTime": func(t time.Time) string {
+			return t.Format("Jan 02, 2006 15:04:05")
+		},
+	}
+}
+
+// loadTemplates parses the embedded templates and, if TemplateDir is set,
+// overlays the *.html files found there. Files with the same name as a
+// built-in template replace it; others are added and can be used as
+// partials. A broken overlay falls back to the built-in templates.
+func (s *VideoServer) loadTemplates() {
+	s.embedded = template.Must(s.parseEmbedded())
+	s.Template = s.embedded
+	if s.Config.TemplateDir != "" {
+		s.templateModTime = templatesModTime(s.Config.TemplateDir)
+		s.Template = s.overlayTemplates()
+	}
+}
+
+// parseEmbedded parses a fresh copy of the built-in templates. Overlays need
+// their own copy because a template set cannot be cloned once executed.
+func (s *VideoServer) parseEmbedded() (*template.Template, error) {
+	return template.New("pages").Funcs(s.templateFuncs()).
+		ParseFS(templates.GetTemplatesFS(), "templates/*.html")
+}
+
+func (s *VideoServer) overlayTemplates() *template.Template {
+	dir := s.Config.TemplateDir
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*.html")); len(matches) == 0 {
+		s.Logger.Warn("no templates found, using built-in templates", "dir", dir)
+		return s.embedded
+	}
+
+	tmpl, err := s.parseEmbedded()
+	if err == nil {
+		tmpl, err = tmpl.ParseFS(os.DirFS(dir), "*.html")
+	}
+	if err != nil {
+		s.Logger.Error("parsing templates, using built-in templates", "error", err, "dir", dir)
+		return s.embedded
+	}
+	return tmpl
+}
+
+// templatesModTime returns the newest modification time of the templates in dir
+func templatesModTime(dir string) time.Time {
+	var latest time.Time
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.html"))
+	for _, match := range matches {
+		if info, err := os.Stat(match); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// currentTemplates returns the templates to render with. With
+// TemplateReload on, edited files in TemplateDir are picked up on the next
+// page load.
+func (s *VideoServer) currentTemplates() *template.Template {
+	s.templateMu.Lock()
+	defer s.templateMu.Unlock()
+
+	if s.Config.TemplateReload && s.Config.TemplateDir != "" {
+		if modTime := templatesModTime(s.Config.TemplateDir); !modTime.Equal(s.templateModTime) {
+			s.templateModTime = modTime
+			s.Template = s.overlayTemplates()
+		}
+	}
+	return s.Template
+}
+
+// renderPage executes a page template into a buffer and sends it. If a
+// custom template fails at execution time the built-in one is used instead.
+func (s *VideoServer) renderPage(w *Response, name string, data any) {
+	tmpl := s.currentTemplates()
+	var body bytes.Buffer
+	err := tmpl.ExecuteTemplate(&body, name, data)
+	if err != nil && tmpl != s.embedded {
+		w.Conn.Log.Error("executing custom template, using built-in template", "error", err, "template", name)
+		body.Reset()
+		err = s.embedded.ExecuteTemplate(&body, name, data)
+	}
+	if err != nil {
+		w.Conn.Log.Error("executing template", "error", err, "template", name)
+		s.writeError(w, 500, "Internal Server Error")
+		s.Metrics.IncrementErrors()
+		return
+	}
+
+	s.writeText(w, 200, "text/html; charset=utf-8", body.Bytes())
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"ren.local/gocast/pkg/models"
+)
+
+// previewPath is where the hover preview clip for a video is cached
+func (s *VideoServer) previewPath(videoID string) string {
+	return filepath.Join(s.Config.ThumbnailDir, "previews", videoID+".mp4")
+}
+
+// previewStale reports whether the preview clip is missing or older than the video
+func (s *VideoServer) previewStale(video models.VideoFile) bool {
+	info, err := os.Stat(s.previewPath(video.VideoID))
+	return err != nil || info.ModTime().Before(video.LastModified)
+}
+
+// queuePreview schedules preview generation on the background workers
+func (s *VideoServer) queuePreview(video models.VideoFile, priority int) {
+	s.Jobs.Enqueue("preview:"+video.VideoID, priority, func() error {
+		return s.generatePreview(video)
+	})
+}
+
+// generatePreview stitches short silent segments sampled across the video
+// into a small looping MP4 for the library's hover previews
+func (s *VideoServer) generatePreview(video models.VideoFile) error {
+	video = s.probeVideo(video)
+	duration := video.Media.Duration
+	if duration <= 0 {
+		return fmt.Errorf("unknown duration")
+	}
+
+	segments := s.Config.PreviewSegments
+	length := s.Config.PreviewSegmentLength.Seconds()
+	videoPath := filepath.Join(s.Config.VideoDir, video.Name)
+
+	// Short videos are previewed from the start instead of sampled
+	var starts []float64
+	if segments < 1 || duration < float64(segments)*length*2 {
+		starts = []float64{0}
+		length = math.Min(duration, float64(max(segments, 1))*length)
+	} else {
+		for i := 0; i < segments; i++ {
+			starts = append(starts, duration*(0.1+0.8*float64(i)/float64(max(segments-1, 1))))
+		}
+	}
+
+	args := []string{}
+	var filter strings.Builder
+	for i, start := range starts {
+		args = append(args,
+			"-ss", strconv.FormatFloat(start, 'f', 3, 64),
+			"-t", strconv.FormatFloat(length, 'f', 3, 64),
+			"-i", videoPath,
+		)
+		fmt.Fprintf(&filter, "[%d:v]scale=%d:-2,setsar=1,fps=24[v%d];", i, s.Config.PreviewWidth, i)
+	}
+	for i := range starts {
+		fmt.Fprintf(&filter, "[v%d]", i)
+	}
+	fmt.Fprintf(&filter, "concat=n=%d:v=1:a=0[out]", len(starts))
+
+	outputPath := s.previewPath(video.VideoID)
+	if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+		return err
+	}
+	tmpPath := outputPath + ".tmp"
+
+	args = append(args,
+		"-filter_complex", filter.String(),
+		"-map", "[out]",
+		"-an",
+		"-c:v", "libx264",
+		"-preset", "veryfast",
+		"-crf", "30",
+		"-pix_fmt", "yuv420p",
+		"-movflags", "+faststart",
+		"-f", "mp4",
+		"-y",
+		tmpPath,
+	)
+
+	cmd := exec.CommandContext(s.Ctx, "ffmpeg", args...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("ffmpeg error: %v, output: %s", err, string(output))
+	}
+	return os.Rename(tmpPath, outputPath)
+}
+
+func (s *VideoServer) handlePreview(w *Response, path string, headers map[string]string) {
+	videoID := filepath.Base(path)
+	video, exists := s.VideoStore.GetVideo(videoID)
+	if !exists {
+		s.writeError(w, 404, "Video Not Found")
+		s.Metrics.IncrementErrors()
+		return
+	}
+
+	if s.previewStale(video) {
+		s.queuePreview(video, PriorityHigh)
+		if !fileExists(s.previewPath(videoID)) {
+			s.writeError(w, 404, "Preview Not Ready")
+			return
+		}
+	}
+
+	s.serveVideo(w, s.previewPath(videoID), headers)
+}
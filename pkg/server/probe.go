@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"ren.local/gocast/pkg/models"
+)
+
+// probeResult mirrors the parts of ffprobe's JSON output we care about
+type probeResult struct {
+	Format struct {
+		Duration string `json:"duration"`
+		BitRate  string `json:"bit_rate"`
+	} `json:"format"`
+	Streams []probeStream `json:"streams"`
+}
+
+type probeStream struct {
+	Index       int               `json:"index"`
+	CodecType   string            `json:"codec_type"`
+	CodecName   string            `json:"codec_name"`
+	Width       int               `json:"width"`
+	Height      int               `json:"height"`
+	Channels    int               `json:"channels"`
+	Tags        map[string]string `json:"tags"`
+	Disposition map[string]int    `json:"disposition"`
+}
+
+// probeFile runs ffprobe against a media file and decodes its stream list.
+// ffprobe is killed if ctx is cancelled.
+func probeFile(ctx context.Context, path string) (*probeResult, error) {
+	cmd := exec.CommandContext(ctx, "ffprobe",
+		"-v", "error",
+		"-print_format", "json",
+		"-show_format",
+		"-show_streams",
+		path,
+	)
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe error: %v", err)
+	}
+
+	var result probeResult
+	if err := json.Unmarshal(output, &result); err != nil {
+		return nil, fmt.Errorf("failed to decode ffprobe output: %v", err)
+	}
+	return &result, nil
+}
+
+// mediaInfo converts raw ffprobe output into the model stored on a VideoFile
+func (p *probeResult) mediaInfo() *models.MediaInfo {
+	info := &models.MediaInfo{}
+	info.Duration, _ = strconv.ParseFloat(p.Format.Duration, 64)
+	info.Bitrate, _ = strconv.ParseInt(p.Format.BitRate, 10, 64)
+
+	subtitleCount, audioCount := 0, 0
+	for _, stream := range p.Streams {
+		switch stream.CodecType {
+		case "video":
+			if info.Width == 0 && stream.Disposition["attached_pic"] == 0 {
+				info.Width, info.Height = stream.Width, stream.Height
+			}
+		case "audio":
+			language := stream.Tags["language"]
+			info.AudioTracks = append(info.AudioTracks, models.AudioTrack{
+				Index:    audioCount,
+				Stream:   stream.Index,
+				Language: language,
+				Codec:    stream.CodecName,
+				Channels: stream.Channels,
+				Label:    audioLabel(audioCount, stream.Tags["title"], language, stream.CodecName, stream.Channels),
+				Default:  stream.Disposition["default"] == 1,
+			})
+			audioCount++
+		case "subtitle":
+			if !textSubtitleCodecs[stream.CodecName] {
+				continue
+			}
+			language := stream.Tags["language"]
+			info.Subtitles = append(info.Subtitles, models.SubtitleTrack{
+				ID:       fmt.Sprintf("e%d", subtitleCount),
+				Label:    subtitleLabel(stream.Tags["title"], language, stream.Disposition["forced"] == 1),
+				Language: language,
+				Format:   stream.CodecName,
+				Stream:   stream.Index,
+				Default:  stream.Disposition["default"] == 1,
+				Forced:   stream.Disposition["forced"] == 1,
+			})
+			subtitleCount++
+		}
+	}
+	return info
+}
+
+// probeVideo fills in stream information for a video the first time it is needed
+func (s *VideoServer) probeVideo(video models.VideoFile) models.VideoFile {
+	if video.Media != nil {
+		return video
+	}
+
+	result, err := probeFile(s.Ctx, filepath.Join(s.Config.VideoDir, video.Name))
+	if err != nil {
+		s.Logger.Warn("probing video", "error", err, "video", video.Name)
+		video.Media = &models.MediaInfo{}
+	} else {
+		video.Media = result.mediaInfo()
+	}
+
+	s.VideoStore.AddVideo(video)
+	return video
+}
+
+// audioLabel builds the text shown in the watch page's audio track menu
+func audioLabel(index int, title, language, codec string, channels int) string {
+	label := subtitleLabel(title, language, false)
+	if label == "Unknown" {
+		label = fmt.Sprintf("Track %d", index+1)
+	}
+
+	layout := fmt.Sprintf("%dch", channels)
+	switch channels {
+	case 1:
+		layout = "Mono"
+	case 2:
+		layout = "Stereo"
+	case 6:
+		layout = "5.1"
+	case 8:
+		layout = "7.1"
+	}
+	return fmt.Sprintf("%s (%s %s)", label, strings.ToUpper(codec), layout)
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// inNetworks reports whether ip falls within any of the CIDRs
+func inNetworks(ip net.IP, cidrs []string) bool {
+	if ip == nil {
+		return false
+	}
+	for _, cidr := range cidrs {
+		if _, network, err := net.ParseCIDR(cidr); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// fromTrustedProxy reports whether a connection comes from one of
+// TrustedProxies. A unix socket is only reachable by processes its file
+// mode admits, which is the reverse proxy it was made for, so its peers are
+// always trusted.
+func (s *VideoServer) fromTrustedProxy(conn net.Conn) bool {
+	if conn.LocalAddr().Network() == "unix" {
+		return true
+	}
+	return inNetworks(net.ParseIP(clientIP(conn)), s.Config.TrustedProxies)
+}
+
+// forwardedParams parses an RFC 7239 Forwarded header into one map per hop
+func forwardedParams(header string) []map[string]string {
+	var hops []map[string]string
+	for _, element := range strings.Split(header, ",") {
+		params := make(map[string]string)
+		for _, pair := range strings.Split(element, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok {
+				params[strings.ToLower(key)] = strings.Trim(value, `"`)
+			}
+		}
+		hops = append(hops, params)
+	}
+	return hops
+}
+
+// forwardedIP strips the port and IPv6 brackets from a Forwarded for= value
+func forwardedIP(node string) string {
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return strings.Trim(node, "[]")
+}
+
+// unknownClient stands for the client of a proxied request that did not say
+// who it came from, as RFC 7239 spells it. It is not an IP, so it is never
+// in AdminNetworks.
+const unknownClient = "unknown"
+
+// requestIP returns the client's address. When the connection comes from a
+// trusted proxy it is taken from Forwarded or X-Forwarded-For, read right to
+// left and skipping hops that are themselves trusted proxies. A trusted
+// proxy that sends neither header, or no address in its own hop, gives
+// unknownClient rather than its own, often loopback, address.
+func (s *VideoServer) requestIP(conn net.Conn, headers map[string]string) string {
+	if !s.fromTrustedProxy(conn) {
+		return clientIP(conn)
+	}
+
+	var hops []string
+	if forwarded := headers["Forwarded"]; forwarded != "" {
+		for _, params := range forwardedParams(forwarded) {
+			hops = append(hops, forwardedIP(params["for"]))
+		}
+	} else if xff := headers["X-Forwarded-For"]; xff != "" {
+		for _, hop := range strings.Split(xff, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+
+	ip := unknownClient
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(hops[i])
+		if hop == nil {
+			break
+		}
+		ip = hop.String()
+		if !inNetworks(hop, s.Config.TrustedProxies) {
+			break
+		}
+	}
+	return ip
+}
+
+// relayedByUntrustedProxy reports whether a request carries forwarding
+// headers but its peer is not one of TrustedProxies. The peer is then a proxy
+// whose clients we cannot tell apart, and its address says nothing about
+// them.
+func (s *VideoServer) relayedByUntrustedProxy(conn net.Conn, headers map[string]string) bool {
+	if s.fromTrustedProxy(conn) {
+		return false
+	}
+	for _, name := range []string{"Forwarded", "X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "X-Real-Ip"} {
+		if headers[name] != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// requestOrigin returns the scheme and host the client used, which differ
+// from ours when a trusted proxy terminates TLS or rewrites the host
+func (s *VideoServer) requestOrigin(conn net.Conn, headers map[string]string) (scheme, host string) {
+	scheme, host = "http", headers["Host"]
+	if !s.fromTrustedProxy(conn) {
+		return scheme, host
+	}
+
+	if forwarded := headers["Forwarded"]; forwarded != "" {
+		// The first element was added by the proxy nearest the client
+		params := forwardedParams(forwarded)[0]
+		if proto := params["proto"]; proto != "" {
+			scheme = proto
+		}
+		if h := params["host"]; h != "" {
+			host = h
+		}
+		return scheme, host
+	}
+	if proto, _, _ := strings.Cut(headers["X-Forwarded-Proto"], ","); proto != "" {
+		scheme = strings.TrimSpace(proto)
+	}
+	if h, _, _ := strings.Cut(headers["X-Forwarded-Host"], ","); h != "" {
+		host = strings.TrimSpace(h)
+	}
+	return scheme, host
+}
+
+// normalizeBasePath turns "media/" or "/media/" into "/media" and "/" into ""
+func normalizeBasePath(base string) string {
+	base = strings.Trim(base, "/")
+	if base == "" {
+		return ""
+	}
+	return "/" + base
+}
+
+// redirect sends a permanent redirect to path under the base path, using the
+// scheme and host the client originally asked for
+func (s *VideoServer) redirect(w *Response, headers map[string]string, path string) {
+	location := s.Config.BasePath + path
+	if scheme, host := s.requestOrigin(w.Conn.Conn, headers); host != "" {
+		location = fmt.Sprintf("%s://%s%s", scheme, host, location)
+	}
+	w.Header().Set("Location", location)
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(301)
+}
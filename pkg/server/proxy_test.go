@@ -0,0 +1,215 @@
+package server
+
+import (
+	"net"
+	"testing"
+)
+
+// addrConn is a net.Conn that only has addresses, for the functions that
+// look at who a connection is from
+type addrConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c addrConn) LocalAddr() net.Addr  { return c.local }
+func (c addrConn) RemoteAddr() net.Addr { return c.remote }
+
+// tcpPeer is a TCP connection from ip
+func tcpPeer(ip string) net.Conn {
+	return addrConn{
+		local:  &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 4221},
+		remote: &net.TCPAddr{IP: net.ParseIP(ip), Port: 50000},
+	}
+}
+
+// unixPeer is a connection on a unix socket listener
+func unixPeer() net.Conn {
+	return addrConn{
+		local:  &net.UnixAddr{Name: "/run/gocast.sock", Net: "unix"},
+		remote: &net.UnixAddr{Name: "@", Net: "unix"},
+	}
+}
+
+// proxyTestServer has just the config the proxy functions read
+func proxyTestServer(trusted ...string) *VideoServer {
+	config := DefaultConfig()
+	config.TrustedProxies = trusted
+	return &VideoServer{Config: config}
+}
+
+func TestAdminBehindProxy(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted []string
+		conn    net.Conn
+		headers map[string]string
+		admin   bool
+	}{
+		{"local client", nil, tcpPeer("127.0.0.1"), nil, true},
+		{"remote client", nil, tcpPeer("203.0.113.7"), nil, false},
+		{"unix proxy without forwarding headers", nil, unixPeer(), nil, false},
+		{"unix proxy forwarding a visitor", nil, unixPeer(), map[string]string{"X-Forwarded-For": "203.0.113.7"}, false},
+		{"unix proxy forwarding a local client", nil, unixPeer(), map[string]string{"X-Forwarded-For": "127.0.0.1"}, true},
+		{"trusted proxy without forwarding headers", []string{"127.0.0.1/32"}, tcpPeer("127.0.0.1"), nil, false},
+		{"trusted proxy without a client address", []string{"127.0.0.1/32"}, tcpPeer("127.0.0.1"), map[string]string{"Forwarded": "proto=https"}, false},
+		{"trusted proxy forwarding a visitor", []string{"127.0.0.1/32"}, tcpPeer("127.0.0.1"), map[string]string{"X-Forwarded-For": "203.0.113.7"}, false},
+		{"untrusted local proxy", nil, tcpPeer("127.0.0.1"), map[string]string{"X-Forwarded-For": "203.0.113.7"}, false},
+		{"untrusted local proxy sending only the scheme", nil, tcpPeer("127.0.0.1"), map[string]string{"X-Forwarded-Proto": "https"}, false},
+		{"untrusted local proxy with Forwarded", nil, tcpPeer("127.0.0.1"), map[string]string{"Forwarded": "for=127.0.0.1"}, false},
+	}
+
+	for _, tt := range tests {
+		s := proxyTestServer(tt.trusted...)
+		headers := tt.headers
+		if headers == nil {
+			headers = map[string]string{}
+		}
+		ip := s.requestIP(tt.conn, headers)
+		if admin := s.isAdmin(tt.conn, ip, headers); admin != tt.admin {
+			t.Errorf("%s: client %q admin = %v, want %v", tt.name, ip, admin, tt.admin)
+		}
+	}
+}
+
+func TestRequestIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted []string
+		conn    net.Conn
+		headers map[string]string
+		want    string
+	}{
+		{"direct client", nil, tcpPeer("203.0.113.7"), nil, "203.0.113.7"},
+		{"untrusted peer's header ignored", nil, tcpPeer("203.0.113.7"),
+			map[string]string{"X-Forwarded-For": "198.51.100.1"}, "203.0.113.7"},
+		{"trusted proxy", []string{"10.0.0.0/8"}, tcpPeer("10.0.0.2"),
+			map[string]string{"X-Forwarded-For": "203.0.113.7"}, "203.0.113.7"},
+		{"spoofed hops left of the client", []string{"10.0.0.0/8"}, tcpPeer("10.0.0.2"),
+			map[string]string{"X-Forwarded-For": "127.0.0.1, 198.51.100.1, 203.0.113.7"}, "203.0.113.7"},
+		{"trusted hops skipped", []string{"10.0.0.0/8"}, tcpPeer("10.0.0.2"),
+			map[string]string{"X-Forwarded-For": "198.51.100.1, 203.0.113.7, 10.0.0.3, 10.0.0.4"}, "203.0.113.7"},
+		{"only trusted hops", []string{"10.0.0.0/8"}, tcpPeer("10.0.0.2"),
+			map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.4"}, "10.0.0.3"},
+		{"garbage hop stops the walk", []string{"10.0.0.0/8"}, tcpPeer("10.0.0.2"),
+			map[string]string{"X-Forwarded-For": "203.0.113.7, nonsense, 10.0.0.3"}, "10.0.0.3"},
+		{"garbage nearest the proxy", []string{"10.0.0.0/8"}, tcpPeer("10.0.0.2"),
+			map[string]string{"X-Forwarded-For": "203.0.113.7, nonsense"}, unknownClient},
+		{"Forwarded", []string{"10.0.0.0/8"}, tcpPeer("10.0.0.2"),
+			map[string]string{"Forwarded": `for=198.51.100.1, for="[2001:db8::1]:4711";proto=https, for=10.0.0.3`}, "2001:db8::1"},
+		{"Forwarded with a port", []string{"10.0.0.0/8"}, tcpPeer("10.0.0.2"),
+			map[string]string{"Forwarded": `for="203.0.113.7:50000"`}, "203.0.113.7"},
+		{"Forwarded preferred", []string{"10.0.0.0/8"}, tcpPeer("10.0.0.2"),
+			map[string]string{"Forwarded": "for=203.0.113.7", "X-Forwarded-For": "198.51.100.1"}, "203.0.113.7"},
+		{"Forwarded without for", []string{"10.0.0.0/8"}, tcpPeer("10.0.0.2"),
+			map[string]string{"Forwarded": "proto=https"}, unknownClient},
+		{"trusted proxy without headers", []string{"10.0.0.0/8"}, tcpPeer("10.0.0.2"), nil, unknownClient},
+		{"unix socket", nil, unixPeer(),
+			map[string]string{"X-Forwarded-For": "203.0.113.7"}, "203.0.113.7"},
+		{"unix socket without headers", nil, unixPeer(), nil, unknownClient},
+	}
+
+	for _, tt := range tests {
+		headers := tt.headers
+		if headers == nil {
+			headers = map[string]string{}
+		}
+		if ip := proxyTestServer(tt.trusted...).requestIP(tt.conn, headers); ip != tt.want {
+			t.Errorf("%s: requestIP = %q, want %q", tt.name, ip, tt.want)
+		}
+	}
+}
+
+func TestRequestOrigin(t *testing.T) {
+	trusted := []string{"10.0.0.0/8"}
+	tests := []struct {
+		name         string
+		conn         net.Conn
+		headers      map[string]string
+		scheme, host string
+	}{
+		{"direct", tcpPeer("203.0.113.7"), map[string]string{"Host": "gocast:4221"}, "http", "gocast:4221"},
+		{"untrusted peer's headers ignored", tcpPeer("203.0.113.7"), map[string]string{
+			"Host": "gocast:4221", "X-Forwarded-Proto": "https", "X-Forwarded-Host": "evil.example",
+		}, "http", "gocast:4221"},
+		{"X-Forwarded", tcpPeer("10.0.0.2"), map[string]string{
+			"Host": "gocast:4221", "X-Forwarded-Proto": "https", "X-Forwarded-Host": "media.example",
+		}, "https", "media.example"},
+		{"X-Forwarded lists", tcpPeer("10.0.0.2"), map[string]string{
+			"Host": "gocast:4221", "X-Forwarded-Proto": "https, http", "X-Forwarded-Host": "media.example, gocast",
+		}, "https", "media.example"},
+		{"X-Forwarded scheme only", tcpPeer("10.0.0.2"), map[string]string{
+			"Host": "media.example", "X-Forwarded-Proto": "https",
+		}, "https", "media.example"},
+		{"Forwarded nearest the client", tcpPeer("10.0.0.2"), map[string]string{
+			"Host":      "gocast:4221",
+			"Forwarded": `for=203.0.113.7;proto=https;host="media.example", for=10.0.0.3;proto=http;host=inner`,
+		}, "https", "media.example"},
+		{"Forwarded preferred", tcpPeer("10.0.0.2"), map[string]string{
+			"Host": "gocast:4221", "Forwarded": "proto=https", "X-Forwarded-Host": "media.example",
+		}, "https", "gocast:4221"},
+		{"no headers", tcpPeer("10.0.0.2"), map[string]string{"Host": "gocast:4221"}, "http", "gocast:4221"},
+	}
+
+	for _, tt := range tests {
+		scheme, host := proxyTestServer(trusted...).requestOrigin(tt.conn, tt.headers)
+		if scheme != tt.scheme || host != tt.host {
+			t.Errorf("%s: requestOrigin = %s, %s; want %s, %s", tt.name, scheme, host, tt.scheme, tt.host)
+		}
+	}
+}
+
+func TestNormalizeBasePath(t *testing.T) {
+	tests := map[string]string{
+		"":             "",
+		"/":            "",
+		"//":           "",
+		"media":        "/media",
+		"/media":       "/media",
+		"media/":       "/media",
+		"/media/":      "/media",
+		"/a/b/":        "/a/b",
+		"/media/video": "/media/video",
+	}
+	for base, want := range tests {
+		if got := normalizeBasePath(base); got != want {
+			t.Errorf("normalizeBasePath(%q) = %q, want %q", base, got, want)
+		}
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	s := newTestServer(t, func(c *Config) {
+		c.BasePath = "media/"
+		c.TrustedProxies = []string{"127.0.0.1/32"}
+	})
+
+	tests := []struct {
+		name     string
+		path     string
+		headers  []string
+		status   int
+		location string
+	}{
+		{name: "prefixed", path: "/media/healthz", status: 200},
+		{name: "prefix stripped by the proxy", path: "/healthz", status: 200},
+		{name: "bare base redirected", path: "/media", status: 301, location: "http://test/media/"},
+		{name: "redirect to the client's origin", path: "/media",
+			headers: []string{"X-Forwarded-For: 203.0.113.7", "X-Forwarded-Proto: https", "X-Forwarded-Host: example.org"},
+			status:  301, location: "https://example.org/media/"},
+		{name: "library under the base", path: "/media/", status: 200},
+		{name: "prefix of another name", path: "/mediafoo/healthz", status: 404},
+	}
+
+	for _, tt := range tests {
+		headers := append([]string{"X-Forwarded-For: 203.0.113.7"}, tt.headers...)
+		resp := dialTest(t, s).get(t, tt.path, headers...)
+		body(t, resp)
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: GET %s status %d, want %d", tt.name, tt.path, resp.StatusCode, tt.status)
+		}
+		if location := resp.Header.Get("Location"); location != tt.location {
+			t.Errorf("%s: GET %s redirected to %q, want %q", tt.name, tt.path, location, tt.location)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"ren.local/gocast/pkg/models"
+)
+
+var errBodyTooLong = errors.New("response body longer than Content-Length")
+
+// Response writes one HTTP/1.1 response on a client connection. Headers set
+// through Header are sent on the first WriteHeader or Write. The body is
+// framed by Content-Length when the handler sets one, chunked otherwise, or
+// delimited by closing the connection for HTTP/1.0 clients.
+type Response struct {
+	Conn      *models.Connection
+	RequestID string
+
+	header         http.Header
+	trailer        http.Header
+	buf            *bufio.Writer
+	acceptEncoding string    // Of the request, for writeText
+	proto11        bool      // Request was HTTP/1.1, so chunked encoding is available
+	keepAlive      bool      // Connection may carry another request after this one
+	started        time.Time // When the request began to arrive, for time to first byte
+
+	status    int
+	chunked   bool
+	bodyless  bool
+	remaining int64 // Bytes left of a declared Content-Length, -1 if none
+	written   int64
+	finished  bool
+}
+
+// newResponse prepares a response to a request with the given protocol
+// version and headers. headers may be nil when no request was read.
+func newResponse(conn *models.Connection, proto string, headers map[string]string) *Response {
+	w := &Response{
+		Conn:      conn,
+		header:    make(http.Header),
+		trailer:   make(http.Header),
+		buf:       bufio.NewWriterSize(conn.Conn, 16*1024),
+		proto11:   proto == "HTTP/1.1",
+		remaining: -1,
+	}
+	connection := strings.ToLower(headers["Connection"])
+	if w.proto11 {
+		w.keepAlive = !strings.Contains(connection, "close")
+	} else {
+		w.keepAlive = proto == "HTTP/1.0" && strings.Contains(connection, "keep-alive")
+	}
+	w.acceptEncoding = headers["Accept-Encoding"]
+	return w
+}
+
+// Header returns the headers that will be sent with the response
+func (w *Response) Header() http.Header {
+	return w.header
+}
+
+// Trailer returns the trailers sent after a chunked body. Their names must
+// be announced beforehand with a "Trailer" header.
+func (w *Response) Trailer() http.Header {
+	return w.trailer
+}
+
+// CloseAfter makes this the last response on the connection
+func (w *Response) CloseAfter() {
+	w.keepAlive = false
+}
+
+// KeepAlive reports whether the connection can be reused once the response
+// is finished
+func (w *Response) KeepAlive() bool {
+	return w.keepAlive
+}
+
+// Status returns the status code sent, or 0 if nothing was sent yet
+func (w *Response) Status() int {
+	return w.status
+}
+
+// Written returns the number of body bytes sent
+func (w *Response) Written() int64 {
+	return w.written
+}
+
+// WriteHeader sends the status line and headers. Later calls do nothing.
+func (w *Response) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+
+	h := w.header
+	w.bodyless = status < 200 || status == 204 || status == 304
+	switch {
+	case w.bodyless:
+		h.Del("Content-Length")
+		h.Del("Transfer-Encoding")
+	case h.Get("Content-Length") != "":
+		w.remaining, _ = strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+	case w.proto11:
+		w.chunked = true
+		h.Set("Transfer-Encoding", "chunked")
+	default:
+		// HTTP/1.0 has no other way to mark the end of an unsized body
+		w.keepAlive = false
+	}
+	if !w.chunked {
+		h.Del("Trailer")
+	}
+
+	switch {
+	case !w.keepAlive:
+		h.Set("Connection", "close")
+	case !w.proto11:
+		h.Set("Connection", "keep-alive")
+	}
+	if w.RequestID != "" {
+		h.Set("X-Request-Id", w.RequestID)
+	}
+
+	fmt.Fprintf(w.buf, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	writeHeaderLines(w.buf, h)
+	w.buf.WriteString("\r\n")
+}
+
+// writeHeaderLines writes header fields in a stable order
+func writeHeaderLines(buf *bufio.Writer, h http.Header) {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range h[name] {
+			// Values can carry request data, such as the host in a redirect,
+			// so a newline must not be able to split the response
+			value = strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+			fmt.Fprintf(buf, "%s: %s\r\n", name, value)
+		}
+	}
+}
+
+// Write sends part of the body, writing a 200 header first if needed
+func (w *Response) Write(p []byte) (int, error) {
+	w.WriteHeader(200)
+	if w.bodyless || len(p) == 0 {
+		return 0, nil
+	}
+	if w.remaining >= 0 && int64(len(p)) > w.remaining {
+		return 0, errBodyTooLong
+	}
+
+	var n int
+	var err error
+	if w.chunked {
+		fmt.Fprintf(w.buf, "%x\r\n", len(p))
+		n, err = w.buf.Write(p)
+		w.buf.WriteString("\r\n")
+	} else {
+		n, err = w.buf.Write(p)
+	}
+	if err != nil {
+		w.keepAlive = false
+	}
+	w.written += int64(n)
+	if w.remaining >= 0 {
+		w.remaining -= int64(n)
+	}
+	return n, err
+}
+
+// ReadFrom copies src into the body. Fixed-length and close-delimited bodies
+// are handed to the connection's own ReadFrom, which lets the runtime use
+// sendfile(2) for files on TCP connections.
+func (w *Response) ReadFrom(src io.Reader) (int64, error) {
+	w.WriteHeader(200)
+	if w.chunked || w.bodyless {
+		return io.Copy(struct{ io.Writer }{w}, src)
+	}
+	if err := w.buf.Flush(); err != nil {
+		return 0, err
+	}
+	if w.remaining >= 0 {
+		// Clamp an existing limit rather than wrapping it, as sendfile only
+		// looks through a single *io.LimitedReader
+		if lr, ok := src.(*io.LimitedReader); ok {
+			lr.N = min(lr.N, w.remaining)
+		} else {
+			src = io.LimitReader(src, w.remaining)
+		}
+	}
+	n, err := io.Copy(w.Conn.Conn, src)
+	if err != nil {
+		w.keepAlive = false
+	}
+	w.written += n
+	if w.remaining >= 0 {
+		w.remaining -= n
+	}
+	return n, err
+}
+
+// Flush sends any buffered data to the client. Live output should flush
+// after each piece so it is not held back waiting for the buffer to fill.
+func (w *Response) Flush() error {
+	w.WriteHeader(200)
+	return w.buf.Flush()
+}
+
+// SetWriteDeadline sets the deadline for sending the response
+func (w *Response) SetWriteDeadline(t time.Time) error {
+	return w.Conn.Conn.SetWriteDeadline(t)
+}
+
+// Finish completes the response: it sends the terminating chunk and any
+// trailers, and flushes. A body shorter than its Content-Length leaves the
+// connection unusable, so keep-alive is turned off in that case.
+func (w *Response) Finish() error {
+	if w.finished {
+		return nil
+	}
+	w.finished = true
+
+	if w.status == 0 {
+		// Nothing was written; send an empty body rather than a chunked one
+		w.header.Set("Content-Length", "0")
+		w.WriteHeader(200)
+	}
+	if w.chunked {
+		w.buf.WriteString("0\r\n")
+		writeHeaderLines(w.buf, w.trailer)
+		w.buf.WriteString("\r\n")
+	}
+	if w.remaining > 0 {
+		w.keepAlive = false
+	}
+	return w.buf.Flush()
+}
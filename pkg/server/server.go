@@ -2,172 +2,388 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"html/template"
 	"log"
+	"log/slog"
 	"net"
 	"os"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"golang.org/x/time/rate"
 	"ren.local/gocast/pkg/models"
-	"ren.local/gocast/pkg/templates"
 )
 
 // VideoServer represents the main server structure
 type VideoServer struct {
-	Listener    net.Listener
+	Listeners   []*Listener
 	Wg          sync.WaitGroup
 	Ctx         context.Context
 	Cancel      context.CancelFunc
 	Metrics     *models.Metrics
-	Connections sync.Map
-	Buffers     map[string]*models.VideoBuffer
-	BuffersMu   sync.RWMutex
+	Connections sync.Map // Connection ID to *models.Connection
+	Cache       *models.BlockCache
 	ConnLimit   chan struct{}
-	Template    *template.Template
+	Template    *template.Template // Active templates, read through currentTemplates
 	Config      *Config
 	VideoStore  *models.VideoStore
+	Jobs        *JobQueue
+	Shaper      *Shaper
+	Guard       *Guard
+	Logger      *slog.Logger
+	Static      *staticAssets
+
+	nextConnID      atomic.Uint64
+	startedAt       time.Time
+	indexLoaded     atomic.Bool        // Set once the saved index has been read at startup
+	embedded        *template.Template // Built-in templates, the fallback for TemplateDir
+	templateMu      sync.Mutex
+	templateModTime time.Time
+	drain           chan struct{} // Closed when Stop begins draining
+	drainOnce       sync.Once
+	upgrading       atomic.Bool // Set while an Upgrade is in progress
+
+	subtitleMu          sync.Mutex
+	subtitleExtractions map[string]*subtitleExtraction // Embedded tracks being extracted, by cache path
 }
 
 // Config holds server configuration
 type Config struct {
-	VideoDir          string
-	Port              string
-	ChunkSize         int64
-	PrefetchSize      int64
-	PrefetchThreshold float64
-	ReadTimeout       time.Duration
-	WriteTimeout      time.Duration
-	MaxConns          int
-	CleanupInterval   time.Duration
-	ThumbnailDir      string
-	ThumbnailQuality  int
-	ThumbnailWidth    int
+	VideoDir             string
+	IndexPath            string           // Saved video index, empty to disable
+	TemplateDir          string           // Custom templates overlaid on the built-in ones
+	TemplateReload       bool             // Re-read TemplateDir when its files change, for development
+	Port                 string           // Address served when Listeners is empty
+	Listeners            []ListenerConfig // Addresses to serve, each with its own routes
+	ChunkSize            int64
+	PrefetchSize         int64 // Bytes read ahead into the cache
+	CacheBlockSize       int64
+	CacheMemoryLimit     int64
+	ZeroCopy             bool     // Use sendfile for uncached ranges on TCP connections
+	CompressEncodings    []string // Content codings for text responses, in preference order
+	CompressMinSize      int      // Smaller bodies are sent uncompressed
+	GzipLevel            int
+	BrotliLevel          int
+	ZstdLevel            int
+	Limits               Limits
+	AdminNetworks        []string // CIDRs allowed to use /admin routes
+	BasePath             string   // URL prefix when served under a sub-path, e.g. "/media"
+	TrustedProxies       []string // CIDRs whose X-Forwarded-For is believed
+	LogLevel             string   // debug, info, warn or error
+	PrefetchThreshold    float64
+	ReadTimeout          time.Duration
+	DrainTimeout         time.Duration // How long Stop lets requests in progress finish
+	UpgradeTimeout       time.Duration // How long Upgrade waits for the new process to serve
+	WriteTimeout         time.Duration
+	StallThreshold       float64 // Fraction of WriteTimeout a write may block before it counts as an underrun
+	MaxConns             int
+	MaxConnsPerIP        int
+	RequestRate          float64 // Requests per second per IP, 0 disables
+	RequestBurst         int
+	MaxHeaderBytes       int
+	MaxHeaderCount       int
+	HeaderTimeout        time.Duration // Deadline for reading the request line and headers
+	IdleTimeout          time.Duration // How long a kept-alive connection waits for its next request
+	BanThreshold         int           // Violations within BanWindow before a ban, 0 disables
+	BanWindow            time.Duration
+	BanDuration          time.Duration
+	CleanupInterval      time.Duration
+	ThumbnailDir         string
+	ThumbnailQuality     int
+	ThumbnailWidth       int
+	ThumbnailWidths      []int
+	ThumbnailFormats     []string // Preference order for content negotiation
+	ThumbnailCandidates  int
+	MaxPosterSize        int64
+	PreviewSegments      int
+	PreviewSegmentLength time.Duration
+	PreviewWidth         int
+	JobWorkers           int
+	JobMaxRetries        int
+	JobRetryBackoff      time.Duration
+	SubtitleDir          string
+	TrickplayInterval    time.Duration
+	TrickplayWidth       int
+	TrickplayColumns     int
+	TrickplayRows        int
 }
 
 // DefaultConfig returns default server configuration
 func DefaultConfig() *Config {
 	return &Config{
 		VideoDir:          "./videos",
+		IndexPath:         "./gocast-index.json",
 		Port:              "0.0.0.0:4221",
 		ChunkSize:         1024 * 64,
 		PrefetchSize:      10 * 1024 * 1024,
-		PrefetchThreshold: 0.7,
-		ReadTimeout:       time.Second * 30,
-		WriteTimeout:      time.Second * 30,
-		MaxConns:          100,
-		CleanupInterval:   time.Minute * 5,
-		ThumbnailDir:      "./thumbnails",
-		ThumbnailQuality:  75,
-		ThumbnailWidth:    480,
+		CacheBlockSize:    1024 * 1024,
+		CacheMemoryLimit:  256 * 1024 * 1024,
+		ZeroCopy:          false,
+		CompressEncodings: []string{"br", "zstd", "gzip"},
+		CompressMinSize:   1024,
+		GzipLevel:         6,
+		BrotliLevel:       5,
+		ZstdLevel:         3,
+		Limits: Limits{
+			Thumbnail:         1024 * 1024,
+			BitrateMultiplier: 1.5,
+			InitialBurst:      30,
+		},
+		AdminNetworks:        []string{"127.0.0.0/8", "::1/128"},
+		LogLevel:             "info",
+		PrefetchThreshold:    0.7,
+		ReadTimeout:          time.Second * 30,
+		DrainTimeout:         time.Second * 30,
+		UpgradeTimeout:       time.Minute,
+		WriteTimeout:         time.Second * 30,
+		StallThreshold:       0.5,
+		MaxConns:             100,
+		MaxConnsPerIP:        10,
+		RequestRate:          20,
+		RequestBurst:         40,
+		MaxHeaderBytes:       16 * 1024,
+		MaxHeaderCount:       100,
+		HeaderTimeout:        time.Second * 10,
+		IdleTimeout:          time.Second * 15,
+		BanThreshold:         10,
+		BanWindow:            time.Minute,
+		BanDuration:          time.Minute * 10,
+		CleanupInterval:      time.Minute * 5,
+		ThumbnailDir:         "./thumbnails",
+		ThumbnailQuality:     75,
+		ThumbnailWidth:       480,
+		ThumbnailWidths:      []int{320, 480, 960, 1920},
+		ThumbnailFormats:     []string{"avif", "webp", "jpeg"},
+		ThumbnailCandidates:  6,
+		MaxPosterSize:        10 * 1024 * 1024,
+		PreviewSegments:      6,
+		PreviewSegmentLength: time.Millisecond * 1500,
+		PreviewWidth:         320,
+		JobWorkers:           2,
+		JobMaxRetries:        3,
+		JobRetryBackoff:      time.Second * 5,
+		SubtitleDir:          "./subtitles",
+		TrickplayInterval:    time.Second * 10,
+		TrickplayWidth:       160,
+		TrickplayColumns:     10,
+		TrickplayRows:        10,
 	}
 }
 
 func New(config *Config) *VideoServer {
 	ctx, cancel := context.WithCancel(context.Background())
+	config.BasePath = normalizeBasePath(config.BasePath)
+
+	logger := newLogger(config)
 
 	// Create required directories
 	if err := ensureDirectories(config); err != nil {
-		log.Printf("Error creating directories: %v", err)
+		logger.Error("creating directories", "error", err)
 	}
 
-	tmpl := template.Must(template.New("videoList").Funcs(template.FuncMap{
-		"BytesToHuman": func(b int64) string {
-			const unit = 1024
-			if b < unit {
-				return fmt.Sprintf("%d B", b)
-			}
-			div, exp := int64(unit), 0
-			for n := b / unit; n >= unit; n /= unit {
-				div *= unit
-				exp++
-			}
-			return fmt.Sprintf("%.1f %cB", float64(b)/float64(div), "KMGTPE"[exp])
-		},
-		"FormatTime": func(t time.Time) string {
-			return t.Format("Jan 02, 2006 15:04:05")
-		},
-	}).ParseFS(templates.GetTemplatesFS(), "templates/*.html"))
+	static, err := loadStaticAssets()
+	if err != nil {
+		log.Fatalf("Error loading static assets: %v", err)
+	}
 
-	return &VideoServer{
+	metrics := models.NewMetrics()
+
+	s := &VideoServer{
 		Ctx:        ctx,
 		Cancel:     cancel,
-		Metrics:    &models.Metrics{},
-		Buffers:    make(map[string]*models.VideoBuffer),
+		Metrics:    metrics,
+		Cache:      models.NewBlockCache(config.CacheMemoryLimit, metrics),
 		ConnLimit:  make(chan struct{}, config.MaxConns),
-		Template:   tmpl,
 		Config:     config,
 		VideoStore: models.NewVideoStore(),
+		Jobs:       NewJobQueue(config.JobMaxRetries, config.JobRetryBackoff, logger),
+		Shaper:     NewShaper(config.Limits, config.ChunkSize),
+		Guard:      NewGuard(config, metrics),
+		Logger:     logger,
+		Static:     static,
+		drain:      make(chan struct{}),
+
+		subtitleExtractions: make(map[string]*subtitleExtraction),
 	}
+	s.loadTemplates()
+	return s
 }
 
 func (s *VideoServer) Start() error {
-	var err error
-	s.Listener, err = net.Listen("tcp", s.Config.Port)
-	if err != nil {
+	if err := s.openListeners(); err != nil {
 		return fmt.Errorf("failed to start server: %v", err)
 	}
+	for _, l := range s.Listeners {
+		s.Logger.Info("server running", "listener", l.Config.name(), "address", l.Addr().String())
+	}
+	s.startedAt = time.Now()
 
-	log.Printf("Server running on %s\n", s.Config.Port)
+	// A broken index only costs a rescan, so it does not hold up readiness
+	if err := s.LoadIndex(); err != nil && !os.IsNotExist(err) {
+		s.Logger.Error("loading index", "error", err)
+	}
+	s.indexLoaded.Store(true)
 
+	s.Jobs.Start(s.Ctx, s.Config.JobWorkers)
 	go s.cleanBuffers()
-	go s.acceptConnections()
+	for _, l := range s.Listeners {
+		s.Wg.Add(1)
+		go s.acceptConnections(l)
+	}
+	s.notifyReady()
 
 	return nil
 }
 
+// Stop drains the server and shuts it down. New connections are refused,
+// idle kept-alive ones closed, and requests in progress get up to
+// DrainTimeout to finish, with every response asking the client to close.
+// Whatever is still running then is cut off, which also kills the ffmpeg
+// processes of remuxes and background jobs. The index is saved last.
 func (s *VideoServer) Stop() {
+	s.drainOnce.Do(func() { close(s.drain) })
+	for _, l := range s.Listeners {
+		l.Close()
+	}
+	s.Connections.Range(func(_, value any) bool {
+		conn := value.(*models.Connection)
+		if conn.IsWaiting() {
+			// Wakes the handler from waiting for a request that may never come
+			conn.Conn.SetReadDeadline(time.Now())
+		}
+		return true
+	})
+
+	done := make(chan struct{})
+	go func() {
+		s.Wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(s.Config.DrainTimeout):
+		s.Logger.Warn("drain timeout reached, closing remaining connections", "timeout", s.Config.DrainTimeout)
+	}
+
 	s.Cancel()
-	if s.Listener != nil {
-		s.Listener.Close()
+	s.Connections.Range(func(_, value any) bool {
+		value.(*models.Connection).Conn.Close()
+		return true
+	})
+	<-done
+	s.Jobs.Wait()
+
+	if err := s.SaveIndex(); err != nil {
+		s.Logger.Error("saving index", "error", err)
 	}
-	s.Wg.Wait()
 }
 
-func (s *VideoServer) acceptConnections() {
+// draining reports whether Stop has been called
+func (s *VideoServer) draining() bool {
+	select {
+	case <-s.drain:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *VideoServer) acceptConnections(l *Listener) {
 	defer s.Wg.Done()
 
 	for {
 		select {
-		case <-s.Ctx.Done():
+		case <-s.drain:
 			return
-		case s.ConnLimit <- struct{}{}:
-			conn, err := s.Listener.Accept()
+		case l.slots <- struct{}{}:
+			conn, err := l.Accept()
 			if err != nil {
-				if !strings.Contains(err.Error(), "use of closed network connection") {
-					log.Printf("Error accepting connection: %v", err)
+				<-l.slots
+				if errors.Is(err, net.ErrClosed) {
+					return
 				}
-				<-s.ConnLimit
+				s.Logger.Error("accepting connection", "error", err, "listener", l.Config.name())
+				continue
+			}
+
+			ip := clientIP(conn)
+			if !l.allows(ip) {
+				l.rejected.Add(1)
+				s.Metrics.RecordRejectedConnection()
+				s.Logger.Warn("rejected connection", "reason", "not allowed on listener", "listener", l.Config.name(), "client_ip", ip)
+				conn.Close()
+				<-l.slots
 				continue
 			}
 
+			// A trusted proxy carries many clients, so admission waits until
+			// handleConnection knows which one the request is for. Probes
+			// are answered whatever the guard thinks of the client.
+			proxied := s.fromTrustedProxy(conn)
+			guarded := !proxied && !l.probesOnly()
+			if guarded {
+				if reason := s.Guard.Admit(ip); reason != "" {
+					l.rejected.Add(1)
+					s.Metrics.RecordRejectedConnection()
+					s.Logger.Warn("rejected connection", "reason", reason, "listener", l.Config.name(), "client_ip", ip)
+					s.rejectConnection(conn, reason)
+					<-l.slots
+					continue
+				}
+			}
+
+			connection := &models.Connection{
+				ID:        s.nextConnID.Add(1),
+				Conn:      conn,
+				Listener:  l.Config.name(),
+				CreatedAt: time.Now(),
+			}
+			s.Connections.Store(connection.ID, connection)
+			s.Metrics.IncrementConnections()
+			l.accepted.Add(1)
+			l.active.Add(1)
+
 			s.Wg.Add(1)
 			go func() {
 				defer func() {
 					conn.Close()
-					<-s.ConnLimit
+					if guarded {
+						s.Guard.Release(ip)
+					}
+					s.Connections.Delete(connection.ID)
+					s.Metrics.DecrementConnections()
+					l.active.Add(-1)
+					<-l.slots
 					s.Wg.Done()
 				}()
 
-				connection := &models.Connection{
-					Conn:      conn,
-					Limiter:   rate.NewLimiter(rate.Limit(1024*1024), 1024*1024),
-					CreatedAt: time.Now(),
-				}
-				s.handleConnection(connection)
+				s.handleConnection(l, connection)
 			}()
 		}
 	}
 }
 
+// rejectConnection turns away a connection refused by the guard. Banned
+// clients are dropped without a response; others get a brief 429.
+func (s *VideoServer) rejectConnection(conn net.Conn, reason string) {
+	defer conn.Close()
+	if reason == RejectBanned {
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	w := newResponse(&models.Connection{Conn: conn}, "HTTP/1.1", nil)
+	s.writeTooManyRequests(w, 10, reason)
+	w.Finish()
+}
+
 // ensureDirectories creates necessary directories if they don't exist
 func ensureDirectories(config *Config) error {
 	dirs := []string{
 		config.VideoDir,
 		config.ThumbnailDir,
+		config.SubtitleDir,
 	}
 
 	for _, dir := range dirs {
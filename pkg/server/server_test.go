@@ -0,0 +1,196 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestServer starts a server on a free loopback port with its
+// directories in a temporary one. configure, if not nil, adjusts the
+// config before the server starts.
+func newTestServer(t testing.TB, configure func(*Config)) *VideoServer {
+	t.Helper()
+	dir := t.TempDir()
+	config := DefaultConfig()
+	config.Port = "127.0.0.1:0"
+	config.VideoDir = filepath.Join(dir, "videos")
+	config.ThumbnailDir = filepath.Join(dir, "thumbnails")
+	config.SubtitleDir = filepath.Join(dir, "subtitles")
+	config.IndexPath = filepath.Join(dir, "index.json")
+	config.LogLevel = "error"
+	config.JobWorkers = 0 // No ffmpeg jobs; tests that want them set workers
+	config.RequestRate = 0
+	if configure != nil {
+		configure(config)
+	}
+
+	s := New(config)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Stop)
+	return s
+}
+
+// addr is the address of the server's first listener
+func (s *VideoServer) addr() string {
+	return s.Listeners[0].Addr().String()
+}
+
+// addTestVideo writes a video file of size bytes of a repeating pattern
+// into the library and returns its ID and contents
+func addTestVideo(t testing.TB, s *VideoServer, name string, size int) (string, []byte) {
+	t.Helper()
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i*7 + i/251)
+	}
+	if err := os.WriteFile(filepath.Join(s.Config.VideoDir, name), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	videos, _ := s.walkLibrary()
+	for _, video := range videos {
+		if video.Name == name {
+			return video.VideoID, data
+		}
+	}
+	t.Fatalf("%s not found in library", name)
+	return "", nil
+}
+
+// testConn is a raw client connection for checking what goes over the wire
+type testConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func dialTest(t testing.TB, s *VideoServer) *testConn {
+	t.Helper()
+	return dialAddr(t, s.addr())
+}
+
+// dialAddr connects to one listener of a server with several
+func dialAddr(t testing.TB, addr string) *testConn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return &testConn{Conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// get sends a GET with the given extra header lines and reads the response
+// head, leaving the body to the caller
+func (c *testConn) get(t testing.TB, path string, headers ...string) *http.Response {
+	t.Helper()
+	return c.do(t, "GET", path, "", headers...)
+}
+
+// do sends a request with a body, if not empty, and reads the response head
+func (c *testConn) do(t testing.TB, method, path, body string, headers ...string) *http.Response {
+	t.Helper()
+	request := fmt.Sprintf("%s %s HTTP/1.1\r\nHost: test\r\n", method, path)
+	if body != "" {
+		request += fmt.Sprintf("Content-Length: %d\r\n", len(body))
+	}
+	for _, h := range headers {
+		request += h + "\r\n"
+	}
+	if _, err := io.WriteString(c, request+"\r\n"+body); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(c.reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// body reads a whole response body
+func body(t testing.TB, resp *http.Response) []byte {
+	t.Helper()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return data
+}
+
+func TestStopDrains(t *testing.T) {
+	s := newTestServer(t, func(c *Config) {
+		c.DrainTimeout = time.Second
+	})
+	// Large enough that a client which stops reading leaves the response
+	// blocked in the socket buffers
+	const size = 32 << 20
+	id, _ := addTestVideo(t, s, "drain.mp4", size)
+
+	// A stream in flight whose client is not reading
+	stream := dialTest(t, s)
+	resp := stream.get(t, "/videos/"+id)
+	if resp.StatusCode != 200 {
+		t.Fatalf("stream status %d", resp.StatusCode)
+	}
+
+	// An idle kept-alive connection
+	idle := dialTest(t, s)
+	body(t, idle.get(t, "/healthz"))
+
+	// A connection part way through sending its request when Stop begins
+	late := dialTest(t, s)
+	io.WriteString(late, "GET /healthz HTTP/1.1\r\nHost: test\r\n")
+	time.Sleep(100 * time.Millisecond)
+
+	stopped := make(chan time.Duration)
+	go func() {
+		began := time.Now()
+		s.Stop()
+		stopped <- time.Since(began)
+	}()
+	for !s.draining() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// New connections are refused
+	if conn, err := net.Dial("tcp", s.addr()); err == nil {
+		conn.Close()
+		t.Error("connection accepted while draining")
+	}
+
+	// The idle connection is closed at once rather than after IdleTimeout
+	idle.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if n, err := idle.reader.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("idle connection: read %d bytes, %v; want EOF", n, err)
+	}
+
+	// A request finished during the drain is answered, asking to close
+	io.WriteString(late, "\r\n")
+	lateResp, err := http.ReadResponse(late.reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body(t, lateResp)
+	if lateResp.StatusCode != 200 || !lateResp.Close {
+		t.Errorf("late request: status %d, close %v; want 200 with Connection: close", lateResp.StatusCode, lateResp.Close)
+	}
+
+	// The stalled stream is cut off once DrainTimeout has passed
+	took := <-stopped
+	if took < s.Config.DrainTimeout || took > s.Config.DrainTimeout+2*time.Second {
+		t.Errorf("Stop took %v with DrainTimeout %v", took, s.Config.DrainTimeout)
+	}
+	n, _ := io.Copy(io.Discard, resp.Body)
+	if n >= size {
+		t.Errorf("stream sent all %d bytes; want it cut off", n)
+	}
+}
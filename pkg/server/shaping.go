@@ -0,0 +1,228 @@
+package server
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"ren.local/gocast/pkg/models"
+)
+
+// Routes with their own bandwidth caps
+const (
+	RouteVideo     = "video"
+	RouteThumbnail = "thumbnail"
+)
+
+// Limits configures bandwidth shaping. Rates are in bytes per second and
+// zero means unlimited.
+type Limits struct {
+	Global            int64            `json:"global"`            // Shared by every stream
+	PerClient         int64            `json:"perClient"`         // Shared by all streams from one IP
+	ClientOverrides   map[string]int64 `json:"clientOverrides"`   // Per-IP replacements for PerClient
+	Video             int64            `json:"video"`             // Per video stream
+	Thumbnail         int64            `json:"thumbnail"`         // Per thumbnail or image response
+	BitrateMultiplier float64          `json:"bitrateMultiplier"` // Pace video at this multiple of its bitrate, 0 disables
+	InitialBurst      float64          `json:"initialBurst"`      // Seconds of media sent unpaced before pacing starts
+}
+
+// clone returns a copy of the limits that shares no map with the original
+func (l Limits) clone() Limits {
+	if l.ClientOverrides != nil {
+		overrides := make(map[string]int64, len(l.ClientOverrides))
+		for ip, r := range l.ClientOverrides {
+			overrides[ip] = r
+		}
+		l.ClientOverrides = overrides
+	}
+	return l
+}
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	refs     int
+	lastUsed time.Time
+}
+
+// streamKey identifies what a client is streaming. Requests for the same
+// key share one limiter, so seeking or re-requesting a range does not
+// start a fresh InitialBurst.
+type streamKey struct {
+	ip    string
+	route string
+	id    string
+}
+
+type streamLimiter struct {
+	limiter  *rate.Limiter
+	route    string
+	bitrate  int64
+	refs     int
+	lastUsed time.Time
+}
+
+// Shaper hands out rate limiters for global, per-client and per-route caps
+// and lets the limits be changed while streams are running
+type Shaper struct {
+	mu        sync.Mutex
+	limits    Limits
+	chunkSize int64
+	global    *rate.Limiter
+	clients   map[string]*clientLimiter
+	streams   map[streamKey]*streamLimiter
+}
+
+// NewShaper creates a shaper. chunkSize is the largest single wait a stream
+// makes, so every bucket must hold at least that much.
+func NewShaper(limits Limits, chunkSize int64) *Shaper {
+	sh := &Shaper{
+		limits:    limits.clone(),
+		chunkSize: chunkSize,
+		clients:   make(map[string]*clientLimiter),
+		streams:   make(map[streamKey]*streamLimiter),
+	}
+	sh.global = rate.NewLimiter(sh.limit(limits.Global), sh.burst(limits.Global))
+	return sh
+}
+
+func (sh *Shaper) limit(bytesPerSecond int64) rate.Limit {
+	if bytesPerSecond <= 0 {
+		return rate.Inf
+	}
+	return rate.Limit(bytesPerSecond)
+}
+
+func (sh *Shaper) burst(bytesPerSecond int64) int {
+	return int(max(bytesPerSecond, sh.chunkSize))
+}
+
+func (sh *Shaper) clientRate(ip string) int64 {
+	if override, ok := sh.limits.ClientOverrides[ip]; ok {
+		return override
+	}
+	return sh.limits.PerClient
+}
+
+// Attach gives a request the global and per-client limiters. The returned
+// function must be called when the request ends. The client's limiter is
+// kept afterwards, so its next request continues from the tokens it left
+// rather than a full bucket, until Cleanup drops it.
+func (sh *Shaper) Attach(conn *models.Connection, ip string) func() {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	client, ok := sh.clients[ip]
+	if !ok {
+		r := sh.clientRate(ip)
+		client = &clientLimiter{limiter: rate.NewLimiter(sh.limit(r), sh.burst(r))}
+		sh.clients[ip] = client
+	}
+	client.refs++
+	conn.Limiters = []*rate.Limiter{sh.global, client.limiter}
+
+	return func() {
+		sh.mu.Lock()
+		defer sh.mu.Unlock()
+		client.refs--
+		client.lastUsed = time.Now()
+	}
+}
+
+// AttachRoute adds the per-stream limiter for a route to a request for id
+// from ip. For video with a known bitrate the stream is paced at
+// BitrateMultiplier times that rate, with a bucket big enough to send
+// InitialBurst worth of media up front. The limiter is kept after the
+// request ends, so a client's next range of the same video continues from
+// the tokens it left, until Cleanup drops it.
+func (sh *Shaper) AttachRoute(conn *models.Connection, ip, route, id string, bitrate int64) func() {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	key := streamKey{ip: ip, route: route, id: id}
+	stream, ok := sh.streams[key]
+	if !ok {
+		stream = &streamLimiter{route: route, bitrate: bitrate}
+		r, b := sh.streamRate(stream)
+		stream.limiter = rate.NewLimiter(r, b)
+		sh.streams[key] = stream
+	} else if stream.bitrate != bitrate {
+		// The file was replaced or probed since the limiter was made
+		stream.bitrate = bitrate
+		r, b := sh.streamRate(stream)
+		stream.limiter.SetLimit(r)
+		stream.limiter.SetBurst(b)
+	}
+	stream.refs++
+	conn.Limiters = append(conn.Limiters, stream.limiter)
+
+	return func() {
+		sh.mu.Lock()
+		defer sh.mu.Unlock()
+		stream.refs--
+		stream.lastUsed = time.Now()
+	}
+}
+
+// Cleanup drops per-client and per-stream limiters no request has used for
+// maxIdle
+func (sh *Shaper) Cleanup(maxIdle time.Duration) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	now := time.Now()
+	for ip, client := range sh.clients {
+		if client.refs == 0 && now.Sub(client.lastUsed) > maxIdle {
+			delete(sh.clients, ip)
+		}
+	}
+	for key, stream := range sh.streams {
+		if stream.refs == 0 && now.Sub(stream.lastUsed) > maxIdle {
+			delete(sh.streams, key)
+		}
+	}
+}
+
+func (sh *Shaper) streamRate(stream *streamLimiter) (rate.Limit, int) {
+	capped := sh.limits.Video
+	if stream.route == RouteThumbnail {
+		capped = sh.limits.Thumbnail
+	}
+
+	if stream.route == RouteVideo && stream.bitrate > 0 && sh.limits.BitrateMultiplier > 0 {
+		paced := int64(float64(stream.bitrate) / 8 * sh.limits.BitrateMultiplier)
+		if capped <= 0 || paced < capped {
+			capped = paced
+		}
+		burst := int64(float64(stream.bitrate) / 8 * sh.limits.InitialBurst)
+		return sh.limit(capped), int(min(max(burst, sh.chunkSize), math.MaxInt32))
+	}
+	return sh.limit(capped), sh.burst(capped)
+}
+
+// Limits returns a copy of the current configuration
+func (sh *Shaper) Limits() Limits {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return sh.limits.clone()
+}
+
+// SetLimits applies new limits to the shaper and to every live stream
+func (sh *Shaper) SetLimits(limits Limits) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	sh.limits = limits.clone()
+	sh.global.SetLimit(sh.limit(limits.Global))
+	sh.global.SetBurst(sh.burst(limits.Global))
+	for ip, client := range sh.clients {
+		r := sh.clientRate(ip)
+		client.limiter.SetLimit(sh.limit(r))
+		client.limiter.SetBurst(sh.burst(r))
+	}
+	for _, stream := range sh.streams {
+		r, b := sh.streamRate(stream)
+		stream.limiter.SetLimit(r)
+		stream.limiter.SetBurst(b)
+	}
+}
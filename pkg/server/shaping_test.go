@@ -0,0 +1,172 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+	"ren.local/gocast/pkg/models"
+)
+
+func TestShaperKeepsStreamLimiters(t *testing.T) {
+	// 8000 bits per second paced at 1x is 1000 bytes per second, with a
+	// two second burst
+	sh := NewShaper(Limits{BitrateMultiplier: 1, InitialBurst: 2}, 100)
+	attach := func(ip, id string) (*models.Connection, func()) {
+		conn := &models.Connection{}
+		release := sh.AttachRoute(conn, ip, RouteVideo, id, 8000)
+		return conn, release
+	}
+	stream := func(conn *models.Connection) *rate.Limiter {
+		return conn.Limiters[len(conn.Limiters)-1]
+	}
+
+	first, release := attach("10.0.0.1", "a")
+	if !stream(first).AllowN(time.Now(), 2000) {
+		t.Fatal("new stream should start with its burst")
+	}
+	release()
+
+	// The same client asking again for the same video carries on paced
+	again, release := attach("10.0.0.1", "a")
+	if stream(again).AllowN(time.Now(), 1000) {
+		t.Error("repeated request got a fresh burst")
+	}
+	release()
+
+	// Other videos and other clients have their own bursts
+	for _, other := range [][2]string{{"10.0.0.1", "b"}, {"10.0.0.2", "a"}} {
+		conn, release := attach(other[0], other[1])
+		if !stream(conn).AllowN(time.Now(), 2000) {
+			t.Errorf("%s streaming %s should have its own burst", other[0], other[1])
+		}
+		release()
+	}
+
+	// Limiters in use survive cleanup; idle ones are dropped
+	held, releaseHeld := attach("10.0.0.3", "a")
+	time.Sleep(10 * time.Millisecond)
+	sh.Cleanup(time.Millisecond)
+	if len(sh.streams) != 1 {
+		t.Errorf("%d limiters after cleanup, want only the one in use", len(sh.streams))
+	}
+	if again, release := attach("10.0.0.3", "a"); stream(again) != stream(held) {
+		t.Error("concurrent requests for one stream should share its limiter")
+	} else {
+		release()
+	}
+	releaseHeld()
+	fresh, release := attach("10.0.0.1", "a")
+	if !stream(fresh).AllowN(time.Now(), 2000) {
+		t.Error("stream should start a new burst after its limiter expired")
+	}
+	release()
+}
+
+func TestRangeRequestsStayPaced(t *testing.T) {
+	const rate = 256 << 10 // Bytes per second
+	s := newTestServer(t, func(c *Config) {
+		c.Limits.BitrateMultiplier = 1
+		c.Limits.InitialBurst = 1
+		c.ChunkSize = 32 << 10
+	})
+	id, _ := addTestVideo(t, s, "paced.mp4", 1<<20)
+	video, _ := s.VideoStore.GetVideo(id)
+	video.Media = &models.MediaInfo{Bitrate: 8 * rate}
+	s.VideoStore.AddVideo(video)
+
+	// Seeking around on new connections, as players do, must not get a new
+	// burst each time: 512KB is one second of burst and one of pacing
+	began := time.Now()
+	for i := 0; i < 4; i++ {
+		conn := dialTest(t, s)
+		start := i * (128 << 10)
+		resp := conn.get(t, "/videos/"+id, fmt.Sprintf("Range: bytes=%d-%d", start, start+(128<<10)-1))
+		if got := body(t, resp); resp.StatusCode != 206 || len(got) != 128<<10 {
+			t.Fatalf("range %d: status %d, %d bytes", i, resp.StatusCode, len(got))
+		}
+		conn.Close()
+	}
+	if took := time.Since(began); took < 800*time.Millisecond {
+		t.Errorf("four ranges took %v; each one got a fresh burst", took)
+	}
+}
+
+func TestPerClientLimitStaysPaced(t *testing.T) {
+	const rate = 256 << 10 // Bytes per second, and the client's burst
+	s := newTestServer(t, func(c *Config) {
+		c.Limits.PerClient = rate
+		c.ChunkSize = 32 << 10
+	})
+	id, _ := addTestVideo(t, s, "client.mp4", 1<<20)
+
+	// Each range is half a second of the client's allowance, so one burst
+	// and one second of pacing cover the lot; a fresh bucket per request
+	// would send them all at once
+	began := time.Now()
+	for i := 0; i < 4; i++ {
+		conn := dialTest(t, s)
+		start := i * (128 << 10)
+		resp := conn.get(t, "/videos/"+id, fmt.Sprintf("Range: bytes=%d-%d", start, start+(128<<10)-1))
+		if got := body(t, resp); resp.StatusCode != 206 || len(got) != 128<<10 {
+			t.Fatalf("range %d: status %d, %d bytes", i, resp.StatusCode, len(got))
+		}
+		conn.Close()
+	}
+	if took := time.Since(began); took < 800*time.Millisecond {
+		t.Errorf("four ranges took %v; each one got a fresh client burst", took)
+	}
+
+	// The limiter is dropped once the client has been idle for a while. The
+	// server may still be finishing the last request, so allow it a moment.
+	clients := func() int {
+		s.Shaper.Cleanup(0)
+		s.Shaper.mu.Lock()
+		defer s.Shaper.mu.Unlock()
+		return len(s.Shaper.clients)
+	}
+	for deadline := time.Now().Add(time.Second); clients() != 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := clients(); n != 0 {
+		t.Errorf("%d client limiters left after cleanup", n)
+	}
+}
+
+func TestAdminLimitsReplacesClientOverrides(t *testing.T) {
+	s := newTestServer(t, func(c *Config) {
+		c.Limits.ClientOverrides = map[string]int64{"10.0.0.1": 100, "10.0.0.2": 200}
+	})
+	post := func(update string) {
+		t.Helper()
+		// Requests with a body close the connection after them
+		resp := dialTest(t, s).do(t, "POST", "/admin/limits", update, "Content-Type: application/json")
+		if got := body(t, resp); resp.StatusCode != 200 {
+			t.Fatalf("POST %s: status %d: %s", update, resp.StatusCode, got)
+		}
+	}
+
+	// Changes to a copy do not reach the shaper
+	limits := s.Shaper.Limits()
+	limits.ClientOverrides["10.0.0.3"] = 300
+	if len(s.Shaper.Limits().ClientOverrides) != 2 {
+		t.Fatal("Limits returned the shaper's own map")
+	}
+
+	post(`{"global": 5000000}`)
+	if overrides := s.Shaper.Limits().ClientOverrides; len(overrides) != 2 {
+		t.Errorf("partial update changed the overrides: %v", overrides)
+	}
+	post(`{"clientOverrides": {"10.0.0.2": 250}}`)
+	if overrides := s.Shaper.Limits().ClientOverrides; len(overrides) != 1 || overrides["10.0.0.2"] != 250 {
+		t.Errorf("overrides %v, want only 10.0.0.2 at 250", overrides)
+	}
+	post(`{"clientOverrides": {}}`)
+	if overrides := s.Shaper.Limits().ClientOverrides; len(overrides) != 0 {
+		t.Errorf("overrides %v, want none", overrides)
+	}
+	if s.Shaper.Limits().Global != 5000000 {
+		t.Error("replacing the overrides lost the global limit")
+	}
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"mime"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"ren.local/gocast/pkg/templates"
+)
+
+// staticAsset is an embedded file served under a content-hashed name, with
+// its compressed variants prepared once at startup
+type staticAsset struct {
+	name        string // Hashed name, e.g. app.3f9c2a1b.css
+	contentType string
+	etag        string
+	data        []byte
+	gzip        []byte
+	brotli      []byte
+}
+
+// staticAssets maps hashed names to assets and original names to hashed ones
+type staticAssets struct {
+	byHash map[string]*staticAsset
+	byName map[string]string
+}
+
+// loadStaticAssets reads every file in the embedded static directory
+func loadStaticAssets() (*staticAssets, error) {
+	assets := &staticAssets{
+		byHash: make(map[string]*staticAsset),
+		byName: make(map[string]string),
+	}
+	staticFS, err := fs.Sub(templates.GetStaticFS(), "static")
+	if err != nil {
+		return nil, err
+	}
+
+	err = fs.WalkDir(staticFS, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(staticFS, name)
+		if err != nil {
+			return err
+		}
+
+		sum := sha256.Sum256(data)
+		hash := hex.EncodeToString(sum[:])[:8]
+		ext := path.Ext(name)
+		asset := &staticAsset{
+			name:        strings.TrimSuffix(name, ext) + "." + hash + ext,
+			contentType: mime.TypeByExtension(ext),
+			etag:        `"` + hash + `"`,
+			data:        data,
+		}
+		if asset.contentType == "" {
+			asset.contentType = "application/octet-stream"
+		}
+		if asset.gzip, err = gzipBytes(data); err != nil {
+			return err
+		}
+		if asset.brotli, err = brotliBytes(data); err != nil {
+			return err
+		}
+
+		assets.byHash[asset.name] = asset
+		assets.byName[name] = asset.name
+		return nil
+	})
+	return assets, err
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func brotliBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := brotli.NewWriterLevel(&buf, brotli.BestCompression)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// URL returns the hashed path for an asset, for use in templates
+func (a *staticAssets) URL(base, name string) string {
+	if hashed, ok := a.byName[name]; ok {
+		return base + "/static/" + hashed
+	}
+	return base + "/static/" + name
+}
+
+// staticEncodings are the codings assets are precompressed in, in
+// preference order
+var staticEncodings = []string{"br", "gzip"}
+
+func (s *VideoServer) handleStatic(w *Response, path string, headers map[string]string) {
+	asset, ok := s.Static.byHash[strings.TrimPrefix(path, "/static/")]
+	if !ok {
+		s.writeError(w, 404, "Not Found")
+		s.Metrics.IncrementErrors()
+		return
+	}
+
+	// The name changes whenever the content does, so it can be cached forever
+	w.Header().Set("ETag", asset.etag)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	if headers["If-None-Match"] == asset.etag {
+		w.WriteHeader(304)
+		return
+	}
+
+	body, encoding := asset.data, negotiateEncoding(headers["Accept-Encoding"], staticEncodings)
+	switch encoding {
+	case "br":
+		body = asset.brotli
+	case "gzip":
+		body = asset.gzip
+	}
+
+	w.Header().Set("Content-Type", asset.contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
+	}
+	w.Header().Set("Vary", "Accept-Encoding")
+	w.Write(body)
+}
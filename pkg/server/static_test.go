@@ -0,0 +1,52 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestStaticEncodingNegotiation(t *testing.T) {
+	s := newTestServer(t, nil)
+	var asset *staticAsset
+	for _, a := range s.Static.byHash {
+		asset = a
+		break
+	}
+	if asset == nil {
+		t.Fatal("no static assets embedded")
+	}
+	conn := dialTest(t, s)
+
+	tests := []struct {
+		accept   string
+		encoding string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip, deflate, br", "br"},
+		{"br;q=0.5, gzip", "gzip"},
+		{"br;q=0, gzip", "gzip"},
+		{"br;q=0.0, gzip;q=0.000", ""},
+		{"BR", "br"},
+		{"*", "br"},
+		{"*;q=0.1, br;q=0", "gzip"},
+		{"xbr, gzipx", ""},
+	}
+	want := map[string][]byte{"": asset.data, "br": asset.brotli, "gzip": asset.gzip}
+
+	for _, tt := range tests {
+		var headers []string
+		if tt.accept != "" {
+			headers = append(headers, "Accept-Encoding: "+tt.accept)
+		}
+		resp := conn.get(t, "/static/"+asset.name, headers...)
+		got := body(t, resp)
+		if encoding := resp.Header.Get("Content-Encoding"); resp.StatusCode != 200 || encoding != tt.encoding {
+			t.Errorf("Accept-Encoding %q: status %d, Content-Encoding %q; want %q", tt.accept, resp.StatusCode, encoding, tt.encoding)
+			continue
+		}
+		if !bytes.Equal(got, want[tt.encoding]) {
+			t.Errorf("Accept-Encoding %q: body is not the %q copy", tt.accept, tt.encoding)
+		}
+	}
+}
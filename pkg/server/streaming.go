@@ -2,99 +2,181 @@ package server
 
 import (
 	"context"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"os"
+	"os/exec"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"ren.local/gocast/pkg/models"
 )
 
-func (s *VideoServer) streamVideo(conn *models.Connection, file *os.File, start, end int64) {
-	buffer := make([]byte, s.Config.ChunkSize)
-	bytesRemaining := end - start + 1
+func (s *VideoServer) streamVideo(w *Response, file *os.File, start, end int64) {
+	conn := w.Conn
+	info, err := file.Stat()
+	if err != nil {
+		conn.Log.Error("reading file info", "error", err)
+		return
+	}
+
+	blockSize := s.Config.CacheBlockSize
+	key := models.BlockKey{Path: file.Name(), ModTime: info.ModTime().UnixNano(), Size: info.Size()}
 	currentPos := start
+	prefetching := &atomic.Bool{}
 
-	if tcpConn, ok := conn.Conn.(*net.TCPConn); ok {
-		tcpConn.SetKeepAlive(true)
-		tcpConn.SetKeepAlivePeriod(30 * time.Second)
+	tcp, isTCP := conn.Conn.(*net.TCPConn)
+	if isTCP {
+		tcp.SetKeepAlive(true)
+		tcp.SetKeepAlivePeriod(30 * time.Second)
 	}
+	zeroCopy := isTCP && s.Config.ZeroCopy
 
-	for bytesRemaining > 0 {
+	for currentPos <= end {
 		select {
 		case <-s.Ctx.Done():
 			return
 		default:
-			s.BuffersMu.RLock()
-			buf, exists := s.Buffers[conn.Conn.RemoteAddr().String()]
-			s.BuffersMu.RUnlock()
-
-			var bytesWritten int
-			var err error
-
-			if exists && currentPos >= buf.Start && currentPos < buf.End {
-				offset := currentPos - buf.Start
-				toWrite := min(buf.End-currentPos, bytesRemaining)
-
-				if offset < 0 || offset+toWrite > int64(len(buf.Data)) {
-					exists = false
-				} else {
-					conn.Conn.SetWriteDeadline(time.Now().Add(s.Config.WriteTimeout))
-					bytesWritten, err = conn.Conn.Write(buf.Data[offset : offset+toWrite])
-					if err == nil {
-						s.Metrics.RecordPrefetchHit()
-						currentPos += int64(bytesWritten)
-					}
+		}
+
+		key.Index = currentPos / blockSize
+		data, hit := s.Cache.Get(key)
+		if hit {
+			s.Metrics.RecordCacheHit()
+		} else if zeroCopy {
+			// Let the kernel copy uncached ranges straight from the page cache
+			s.Metrics.RecordCacheMiss()
+			n := min((key.Index+1)*blockSize, end+1) - currentPos
+			written, err := s.sendFile(w, file, currentPos, n)
+			currentPos += written
+			conn.SetPosition(currentPos)
+			if err != nil {
+				if err != context.Canceled && !isConnectionClosed(err) {
+					conn.Log.Error("sending file", "error", err, "offset", currentPos)
 				}
+				return
 			}
-
-			if !exists || err != nil {
-				s.Metrics.RecordPrefetchMiss()
-
-				n := min(int64(len(buffer)), bytesRemaining)
-				bytesRead, err := file.Read(buffer[:n])
-				if err != nil {
-					if err != io.EOF {
-						if !isConnectionClosed(err) {
-							log.Printf("Error reading file: %v", err)
-						}
-					}
-					return
+			continue
+		} else {
+			s.Metrics.RecordCacheMiss()
+			data, err = s.Cache.Load(key, func() ([]byte, error) {
+				return readBlock(file, key.Index, blockSize)
+			})
+			if err != nil {
+				if !isConnectionClosed(err) {
+					conn.Log.Error("reading file", "error", err, "offset", currentPos)
 				}
+				return
+			}
+		}
 
-				err = conn.Limiter.WaitN(s.Ctx, bytesRead)
-				if err != nil {
-					if err != context.Canceled {
-						log.Printf("Rate limiting error: %v", err)
-					}
-					return
-				}
+		offset := currentPos - key.Index*blockSize
+		if offset >= int64(len(data)) {
+			return // Past the end of the file
+		}
+		block := data[offset:min(int64(len(data)), offset+end-currentPos+1)]
 
-				conn.Conn.SetWriteDeadline(time.Now().Add(s.Config.WriteTimeout))
-				bytesWritten, err = conn.Conn.Write(buffer[:bytesRead])
-				if err == nil {
-					currentPos += int64(bytesWritten)
+		// Read ahead once playback is far enough into this block. Zero-copy
+		// streams skip this and rely on the kernel's own readahead.
+		if !zeroCopy && float64(offset) >= float64(blockSize)*s.Config.PrefetchThreshold && prefetching.CompareAndSwap(false, true) {
+			go func(logger *slog.Logger, next models.BlockKey) {
+				defer prefetching.Store(false)
+				s.prefetchBlocks(logger, next)
+			}(conn.Log, key)
+		}
+
+		for len(block) > 0 {
+			n := min(int64(len(block)), s.Config.ChunkSize)
+			if err := conn.WaitN(s.Ctx, int(n)); err != nil {
+				if err != context.Canceled {
+					conn.Log.Error("rate limiting", "error", err)
 				}
+				return
 			}
 
+			w.SetWriteDeadline(time.Now().Add(s.Config.WriteTimeout))
+			writeStart := time.Now()
+			bytesWritten, err := w.Write(block[:n])
+			currentPos += int64(bytesWritten)
+			conn.SetPosition(currentPos)
+			s.Metrics.AddBytes(int64(bytesWritten))
+			s.recordChunk(w, int64(bytesWritten), time.Since(writeStart), int64(len(data))-(currentPos-key.Index*blockSize))
+			conn.Touch()
 			if err != nil {
 				if !isConnectionClosed(err) {
-					log.Printf("Error writing to connection: %v", err)
+					conn.Log.Error("writing to connection", "error", err)
 				}
 				return
 			}
+			block = block[n:]
+		}
+	}
+}
 
-			bytesRemaining -= int64(bytesWritten)
-			s.Metrics.AddBytes(int64(bytesWritten))
-			conn.LastActive = time.Now()
+// sendFile writes n bytes of file starting at offset using io.Copy onto the
+// response, which passes it to the connection and the runtime turns into sendfile(2)/splice(2) on TCP so
+// the data never passes through user space. The copy is split into ChunkSize
+// pieces so the rate limiter and write deadline still apply.
+func (s *VideoServer) sendFile(w *Response, file *os.File, offset, n int64) (int64, error) {
+	conn := w.Conn
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
 
-			if !exists || (currentPos >= buf.End && !buf.Prefetching) {
-				go s.prefetchNextSegment(conn, file, currentPos)
-			}
+	var total int64
+	for total < n {
+		chunk := min(n-total, s.Config.ChunkSize)
+		if err := conn.WaitN(s.Ctx, int(chunk)); err != nil {
+			return total, err
 		}
+
+		w.SetWriteDeadline(time.Now().Add(s.Config.WriteTimeout))
+		writeStart := time.Now()
+		written, err := io.CopyN(w, file, chunk)
+		total += written
+		s.Metrics.AddBytes(written)
+		s.recordChunk(w, written, time.Since(writeStart), 0)
+		conn.Touch()
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// recordChunk updates throughput tracking after a write of n bytes that
+// took the given time, with gap bytes of the block still cached ahead of it.
+// A write blocking for more than StallThreshold of WriteTimeout means the
+// client has stopped draining, so its player is about to run dry.
+func (s *VideoServer) recordChunk(w *Response, n int64, took time.Duration, gap int64) {
+	conn := w.Conn
+	conn.RecordSent(n)
+	s.Metrics.Streaming.RecordChunk(n, float64(gap))
+
+	if took > time.Duration(float64(s.Config.WriteTimeout)*s.Config.StallThreshold) {
+		conn.RecordUnderrun()
+		s.Metrics.Streaming.RecordUnderrun()
+		conn.Log.Warn("slow client", "write_ms", took.Milliseconds(), "position", w.Written())
 	}
+	if n > 0 && w.Written() == n && !w.started.IsZero() {
+		ttfb := time.Since(w.started)
+		conn.SetTTFB(ttfb)
+		s.Metrics.Streaming.RecordTTFB(ttfb)
+	}
+}
+
+// readBlock reads one cache block from the file
+func readBlock(file *os.File, index, blockSize int64) ([]byte, error) {
+	data := make([]byte, blockSize)
+	n, err := file.ReadAt(data, index*blockSize)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return data[:n], nil
 }
 
 // Helper function to check if an error is due to connection closure
@@ -111,65 +193,35 @@ func isConnectionClosed(err error) bool {
 		strings.Contains(errStr, "use of closed network connection")
 }
 
-func (s *VideoServer) prefetchNextSegment(conn *models.Connection, originalFile *os.File, start int64) {
-	fileName := originalFile.Name()
-	newFile, err := os.Open(fileName)
+// prefetchBlocks loads the PrefetchSize bytes following the block in key
+// into the shared cache. It opens its own handle because the streaming
+// request may finish and close its file first. Errors are logged to the
+// request's logger.
+func (s *VideoServer) prefetchBlocks(logger *slog.Logger, key models.BlockKey) {
+	file, err := os.Open(key.Path)
 	if err != nil {
-		if !isConnectionClosed(err) {
-			log.Printf("Error opening file for prefetch: %v", err)
-		}
+		logger.Warn("opening file for prefetch", "error", err, "path", key.Path)
 		return
 	}
-	defer newFile.Close()
+	defer file.Close()
 
-	s.BuffersMu.Lock()
-	buf, exists := s.Buffers[conn.Conn.RemoteAddr().String()]
-	if exists && buf.Prefetching {
-		s.BuffersMu.Unlock()
-		return
-	}
-
-	if !exists {
-		buf = &models.VideoBuffer{
-			Data:        make([]byte, s.Config.PrefetchSize),
-			Start:       start,
-			LastAccess:  time.Now(),
-			Prefetching: true,
+	blockSize := s.Config.CacheBlockSize
+	last := min(key.Index+s.Config.PrefetchSize/blockSize, (key.Size-1)/blockSize)
+	for key.Index < last {
+		key.Index++
+		if s.Ctx.Err() != nil {
+			return
 		}
-		s.Buffers[conn.Conn.RemoteAddr().String()] = buf
-	} else {
-		buf.Prefetching = true
-		buf.Start = start
-	}
-	s.BuffersMu.Unlock()
-
-	_, err = newFile.Seek(start, 0)
-	if err != nil {
-		if !isConnectionClosed(err) {
-			log.Printf("Error seeking in file for prefetch: %v", err)
+		if s.Cache.Contains(key) {
+			continue
 		}
-		s.BuffersMu.Lock()
-		buf.Prefetching = false
-		s.BuffersMu.Unlock()
-		return
-	}
-
-	n, err := io.ReadFull(newFile, buf.Data)
-	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
-		if !isConnectionClosed(err) {
-			log.Printf("Error prefetching: %v", err)
+		if _, err := s.Cache.Load(key, func() ([]byte, error) {
+			return readBlock(file, key.Index, blockSize)
+		}); err != nil {
+			logger.Warn("prefetching", "error", err, "path", key.Path, "block", key.Index)
+			return
 		}
-		s.BuffersMu.Lock()
-		buf.Prefetching = false
-		s.BuffersMu.Unlock()
-		return
 	}
-
-	s.BuffersMu.Lock()
-	buf.End = start + int64(n)
-	buf.LastAccess = time.Now()
-	buf.Prefetching = false
-	s.BuffersMu.Unlock()
 }
 
 func min(a, b int64) int64 {
@@ -179,10 +231,130 @@ func min(a, b int64) int64 {
 	return b
 }
 
+// cleanBuffers is the janitor: every CleanupInterval it evicts cache blocks
+// nobody has read recently and closes kept-alive connections left idle,
+// until the server's context is cancelled
 func (s *VideoServer) cleanBuffers() {
-	for addr, buf := range s.Buffers {
-		if time.Since(buf.LastAccess) > s.Config.CleanupInterval {
-			delete(s.Buffers, addr)
+	ticker := time.NewTicker(s.Config.CleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.Ctx.Done():
+			return
+		case <-ticker.C:
+			s.janitorPass()
+		}
+	}
+}
+
+// janitorPass runs a single sweep and returns what it removed
+func (s *VideoServer) janitorPass() (idleBlocks, staleConnections int) {
+	idleBlocks = s.Cache.EvictIdle(s.Config.CleanupInterval)
+
+	s.Connections.Range(func(key, value any) bool {
+		conn := value.(*models.Connection)
+		// Only kept-alive connections between requests are closed; one
+		// that is reading a request or sending a response may simply not
+		// have touched its activity time yet
+		if conn.IsWaiting() && conn.IdleFor() > s.Config.CleanupInterval {
+			// Closing unblocks the handler goroutine, which then deregisters
+			conn.Conn.Close()
+			s.Connections.Delete(key)
+			staleConnections++
+		}
+		return true
+	})
+
+	s.Guard.Cleanup(s.Config.CleanupInterval)
+	s.Shaper.Cleanup(s.Config.CleanupInterval)
+	s.Metrics.RecordJanitorPass(idleBlocks, staleConnections)
+	return idleBlocks, staleConnections
+}
+
+// browserAudioCodecs can be copied into a fragmented MP4 without re-encoding
+var browserAudioCodecs = map[string]bool{
+	"aac":  true,
+	"mp3":  true,
+	"opus": true,
+}
+
+// streamRemux pipes the video together with a chosen audio track through
+// ffmpeg as fragmented MP4. The output has no known length, so it is sent
+// chunked and seeking is handled by restarting at offset.
+func (s *VideoServer) streamRemux(w *Response, videoPath string, track models.AudioTrack, offset float64) {
+	args := []string{
+		"-ss", strconv.FormatFloat(offset, 'f', 3, 64),
+		"-i", videoPath,
+		"-map", "0:v:0",
+		"-map", fmt.Sprintf("0:a:%d", track.Index),
+		"-c:v", "copy",
+	}
+	if browserAudioCodecs[track.Codec] {
+		args = append(args, "-c:a", "copy")
+	} else {
+		// Browsers downmix anyway and AAC 5.1 support is patchy
+		args = append(args, "-c:a", "aac", "-ac", "2")
+	}
+	args = append(args,
+		"-f", "mp4",
+		"-movflags", "frag_keyframe+empty_moov+default_base_moof",
+		"pipe:1",
+	)
+	cmd := exec.CommandContext(s.Ctx, "ffmpeg", args...)
+	conn := w.Conn
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		s.writeError(w, 500, "Internal Server Error")
+		s.Metrics.IncrementErrors()
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		conn.Log.Error("starting remux", "error", err, "path", videoPath)
+		s.writeError(w, 500, "Internal Server Error")
+		s.Metrics.IncrementErrors()
+		return
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Accept-Ranges", "none")
+	w.WriteHeader(200)
+
+	buffer := make([]byte, s.Config.ChunkSize)
+	for {
+		n, err := stdout.Read(buffer)
+		if n > 0 {
+			if err := conn.WaitN(s.Ctx, n); err != nil {
+				return
+			}
+			w.SetWriteDeadline(time.Now().Add(s.Config.WriteTimeout))
+			writeStart := time.Now()
+			written, werr := w.Write(buffer[:n])
+			if werr == nil {
+				// Each piece is sent as it arrives rather than when the
+				// buffer fills, so playback can start straight away
+				werr = w.Flush()
+			}
+			s.Metrics.AddBytes(int64(written))
+			s.recordChunk(w, int64(written), time.Since(writeStart), 0)
+			conn.Touch()
+			if werr != nil {
+				if !isConnectionClosed(werr) {
+					conn.Log.Error("writing to connection", "error", werr)
+				}
+				return
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				conn.Log.Error("reading remux output", "error", err)
+			}
+			return
 		}
 	}
 }
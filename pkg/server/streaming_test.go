@@ -0,0 +1,239 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"ren.local/gocast/pkg/models"
+)
+
+// cacheBlock loads one block of a library file into the server's cache, as
+// an earlier request or prefetch would have, and returns its key
+func cacheBlock(t testing.TB, s *VideoServer, name string, index int64) models.BlockKey {
+	t.Helper()
+	path := filepath.Join(s.Config.VideoDir, name)
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := models.BlockKey{Path: path, ModTime: info.ModTime().UnixNano(), Size: info.Size(), Index: index}
+	if _, err := s.Cache.Load(key, func() ([]byte, error) {
+		return readBlock(file, index, s.Config.CacheBlockSize)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestZeroCopyMatchesCachedCopy(t *testing.T) {
+	const blockSize = 64 << 10
+	const size = 5*blockSize + 12345
+	small := func(c *Config) {
+		c.CacheBlockSize = blockSize
+		c.ChunkSize = 16 << 10
+		c.PrefetchSize = 2 * blockSize
+	}
+	cached := newTestServer(t, small)
+	zeroCopy := newTestServer(t, func(c *Config) {
+		small(c)
+		c.ZeroCopy = true
+	})
+	id, data := addTestVideo(t, cached, "ranges.mp4", size)
+	if zid, _ := addTestVideo(t, zeroCopy, "ranges.mp4", size); zid != id {
+		t.Fatalf("video IDs differ: %s and %s", id, zid)
+	}
+	// A cached block in the middle makes zero-copy streams switch between
+	// the cache and sendfile
+	cacheBlock(t, zeroCopy, "ranges.mp4", 2)
+
+	ranges := []struct{ start, end int64 }{
+		{0, size - 1},
+		{0, 0},
+		{1, blockSize},
+		{blockSize - 1, blockSize},
+		{blockSize + 17, 3*blockSize + 4093},
+		{2*blockSize - 5, 3*blockSize + 5},
+		{3*blockSize - 1, size - 2},
+		{size - 7, size - 1},
+	}
+
+	for _, server := range []*VideoServer{cached, zeroCopy} {
+		conn := dialTest(t, server)
+		for _, r := range ranges {
+			resp := conn.get(t, "/videos/"+id, fmt.Sprintf("Range: bytes=%d-%d", r.start, r.end))
+			got := body(t, resp)
+			if resp.StatusCode != 206 || !bytes.Equal(got, data[r.start:r.end+1]) {
+				t.Errorf("ZeroCopy %v, bytes %d-%d: status %d, %d bytes not matching the file",
+					server.Config.ZeroCopy, r.start, r.end, resp.StatusCode, len(got))
+			}
+		}
+	}
+
+	// Only the block loaded above is in the zero-copy server's cache; the
+	// rest went through sendfile
+	if blocks := zeroCopy.Cache.Stats()["cacheBlocks"]; blocks != 1 {
+		t.Errorf("zero-copy server cached %d blocks, want 1", blocks)
+	}
+}
+
+// BenchmarkStreamVideo compares serving a whole file from the block cache
+// with sending it from the page cache with sendfile
+// cpuTime is the user and system CPU time used by the process so far
+func cpuTime(b *testing.B) time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		b.Fatal(err)
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+func BenchmarkStreamVideo(b *testing.B) {
+	const size = 16 << 20
+	for _, zeroCopy := range []bool{false, true} {
+		name := "cached"
+		if zeroCopy {
+			name = "sendfile"
+		}
+		b.Run(name, func(b *testing.B) {
+			s := newTestServer(b, func(c *Config) {
+				c.ZeroCopy = zeroCopy
+			})
+			id, _ := addTestVideo(b, s, "bench.mp4", size)
+			conn := dialTest(b, s)
+			// Warm the block cache, or the page cache for sendfile
+			body(b, conn.get(b, "/videos/"+id))
+
+			b.SetBytes(size)
+			b.ResetTimer()
+			started := cpuTime(b)
+			for i := 0; i < b.N; i++ {
+				resp := conn.get(b, "/videos/"+id)
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+			// The client reading the responses shares the process, so this
+			// is an upper bound on what serving costs
+			cpu := cpuTime(b) - started
+			gbit := float64(size) * 8 * float64(b.N) / 1e9
+			b.ReportMetric(float64(cpu)/float64(time.Millisecond)/gbit, "cpu-ms/Gbit")
+		})
+	}
+}
+
+func TestJanitorEvictsIdleBlocksAndConnections(t *testing.T) {
+	s := newTestServer(t, func(c *Config) {
+		c.CacheBlockSize = 64 << 10
+		c.CleanupInterval = 100 * time.Millisecond
+	})
+	addTestVideo(t, s, "janitor.mp4", 4*64<<10)
+	idleKey := cacheBlock(t, s, "janitor.mp4", 0)
+	usedKey := cacheBlock(t, s, "janitor.mp4", 1)
+
+	idle := dialTest(t, s)
+	body(t, idle.get(t, "/healthz"))
+
+	// Keep reading one block so the janitor leaves it alone
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+				s.Cache.Get(usedKey)
+			}
+		}
+	}()
+
+	// The kept-alive connection is closed once it has been idle for longer
+	// than CleanupInterval, well before IdleTimeout
+	idle.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := idle.reader.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("idle connection: read %d bytes, %v; want EOF", n, err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); s.Cache.Contains(idleKey) && time.Now().Before(deadline); {
+		time.Sleep(20 * time.Millisecond)
+	}
+	close(done)
+	wg.Wait()
+
+	if s.Cache.Contains(idleKey) {
+		t.Error("idle block was not evicted")
+	}
+	if !s.Cache.Contains(usedKey) {
+		t.Error("block in use was evicted")
+	}
+	stats := s.Metrics.GetStats()
+	if stats["idleEvictions"] < 1 || stats["staleConnections"] < 1 {
+		t.Errorf("janitor metrics not recorded: %v", stats)
+	}
+}
+
+// TestConcurrentStreamsShareCache has many clients read random ranges of
+// one file through a cache far smaller than it while the janitor runs;
+// run it with -race
+func TestConcurrentStreamsShareCache(t *testing.T) {
+	const blockSize = 64 << 10
+	const size = 10*blockSize + 999
+	s := newTestServer(t, func(c *Config) {
+		c.CacheBlockSize = blockSize
+		c.ChunkSize = 16 << 10
+		c.PrefetchSize = 2 * blockSize
+		c.CacheMemoryLimit = 3 * blockSize
+		c.CleanupInterval = 20 * time.Millisecond
+		// The janitor closes idle kept-alive connections, so clients redial
+		// while the old ones are still counted
+		c.MaxConnsPerIP = 100
+	})
+	id, data := addTestVideo(t, s, "shared.mp4", size)
+	url := fmt.Sprintf("http://%s/videos/%s", s.addr(), id)
+
+	var wg sync.WaitGroup
+	for c := 0; c < 8; c++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			client := &http.Client{Timeout: 10 * time.Second}
+			r := rand.New(rand.NewSource(seed))
+			for i := 0; i < 6; i++ {
+				start := r.Int63n(size)
+				end := start + r.Int63n(size-start)
+				req, _ := http.NewRequest("GET", url, nil)
+				req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+				resp, err := client.Do(req)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				got, err := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if err != nil || !bytes.Equal(got, data[start:end+1]) {
+					t.Errorf("bytes %d-%d: %d bytes not matching the file, %v", start, end, len(got), err)
+					return
+				}
+			}
+		}(int64(c))
+	}
+	wg.Wait()
+
+	if stats := s.Cache.Stats(); stats["cacheBytes"] > stats["cacheLimit"] {
+		t.Errorf("cache over its limit: %v", stats)
+	}
+}
@@ -0,0 +1,439 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"ren.local/gocast/pkg/models"
+)
+
+// subtitleFormats lists sidecar extensions we can turn into WebVTT
+var subtitleFormats = map[string]bool{
+	".vtt": true,
+	".srt": true,
+	".ass": true,
+	".ssa": true,
+}
+
+// textSubtitleCodecs are embedded codecs ffmpeg can convert to WebVTT.
+// Bitmap formats (PGS, VobSub, DVB) would need OCR and are skipped.
+var textSubtitleCodecs = map[string]bool{
+	"subrip":   true,
+	"srt":      true,
+	"ass":      true,
+	"ssa":      true,
+	"webvtt":   true,
+	"mov_text": true,
+	"text":     true,
+}
+
+// languageNames maps common ISO 639 codes to labels shown in the player
+var languageNames = map[string]string{
+	"en": "English", "eng": "English",
+	"fr": "French", "fre": "French", "fra": "French",
+	"de": "German", "ger": "German", "deu": "German",
+	"es": "Spanish", "spa": "Spanish",
+	"it": "Italian", "ita": "Italian",
+	"pt": "Portuguese", "por": "Portuguese",
+	"nl": "Dutch", "dut": "Dutch", "nld": "Dutch",
+	"ru": "Russian", "rus": "Russian",
+	"ja": "Japanese", "jpn": "Japanese",
+	"ko": "Korean", "kor": "Korean",
+	"zh": "Chinese", "chi": "Chinese", "zho": "Chinese",
+	"ar": "Arabic", "ara": "Arabic",
+	"hi": "Hindi", "hin": "Hindi",
+	"sv": "Swedish", "swe": "Swedish",
+	"no": "Norwegian", "nor": "Norwegian",
+	"da": "Danish", "dan": "Danish",
+	"fi": "Finnish", "fin": "Finnish",
+	"pl": "Polish", "pol": "Polish",
+	"tr": "Turkish", "tur": "Turkish",
+}
+
+// subtitleFlags are filename tokens that describe a track rather than its language
+var subtitleFlags = map[string]bool{
+	"sdh": true,
+	"cc":  true,
+}
+
+// findSidecarSubtitles returns subtitle files next to a video that share its
+// base name, e.g. "Movie.srt", "Movie.en.srt" or "Movie.eng.forced.ass".
+// dirCache avoids re-reading the same directory for every video in it.
+func findSidecarSubtitles(videoPath string, dirCache map[string][]os.DirEntry) []models.SubtitleTrack {
+	dir := filepath.Dir(videoPath)
+	entries, ok := dirCache[dir]
+	if !ok {
+		entries, _ = os.ReadDir(dir)
+		dirCache[dir] = entries
+	}
+
+	base := strings.TrimSuffix(filepath.Base(videoPath), filepath.Ext(videoPath))
+	var tracks []models.SubtitleTrack
+	for _, entry := range entries {
+		name := entry.Name()
+		ext := strings.ToLower(filepath.Ext(name))
+		if entry.IsDir() || !subtitleFormats[ext] || !strings.HasPrefix(name, base+".") {
+			continue
+		}
+
+		// Tokens between the video's base name and the extension
+		middle := strings.TrimSuffix(strings.TrimPrefix(name, base), filepath.Ext(name))
+		language, forced, isDefault, extra := "", false, false, []string{}
+		for _, token := range strings.Split(strings.Trim(middle, "."), ".") {
+			lower := strings.ToLower(token)
+			switch {
+			case token == "":
+			case lower == "forced":
+				forced = true
+			case lower == "default":
+				isDefault = true
+			case subtitleFlags[lower]:
+				extra = append(extra, strings.ToUpper(lower))
+			case language == "" && languageCode(lower) != "":
+				language = languageCode(lower)
+			default:
+				extra = append(extra, token)
+			}
+		}
+
+		label := subtitleLabel(strings.Join(extra, " "), language, forced)
+		tracks = append(tracks, models.SubtitleTrack{
+			Label:    label,
+			Language: language,
+			Format:   strings.TrimPrefix(ext, "."),
+			Path:     filepath.Join(dir, name),
+			Default:  isDefault,
+			Forced:   forced,
+		})
+	}
+
+	sort.Slice(tracks, func(i, j int) bool { return tracks[i].Path < tracks[j].Path })
+	for i := range tracks {
+		tracks[i].ID = fmt.Sprintf("s%d", i)
+	}
+	return tracks
+}
+
+// languageCode maps a filename token such as "en", "eng" or "english" to the
+// code used for the track, or returns "" if it is not a known language
+func languageCode(token string) string {
+	if _, ok := languageNames[token]; ok {
+		return token
+	}
+	for code, name := range languageNames {
+		if len(code) == 2 && strings.EqualFold(name, token) {
+			return code
+		}
+	}
+	return ""
+}
+
+// subtitleLabel builds a human readable label for the player's track menu
+func subtitleLabel(title, language string, forced bool) string {
+	label := title
+	if name, ok := languageNames[strings.ToLower(language)]; ok {
+		if label == "" {
+			label = name
+		} else {
+			label = name + " (" + label + ")"
+		}
+	} else if label == "" && language != "" {
+		label = language
+	}
+	if label == "" {
+		label = "Unknown"
+	}
+	if forced {
+		label += " [Forced]"
+	}
+	return label
+}
+
+// srclang returns a two letter language tag for the <track> element
+func srclang(language string) string {
+	language = strings.ToLower(language)
+	name, ok := languageNames[language]
+	if !ok || len(language) == 2 {
+		return language
+	}
+	return languageCode(strings.ToLower(name))
+}
+
+// decodeSubtitleText normalises encoding and line endings. Files that are not
+// valid UTF-8 are assumed to be Latin-1, which covers most legacy SRTs.
+func decodeSubtitleText(data []byte) string {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	var text string
+	if utf8.Valid(data) {
+		text = string(data)
+	} else {
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		text = string(runes)
+	}
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	return strings.ReplaceAll(text, "\r", "\n")
+}
+
+var srtTiming = regexp.MustCompile(`^(\d+):(\d{2}):(\d{2})[,.](\d{1,3})\s*-->\s*(\d+):(\d{2}):(\d{2})[,.](\d{1,3})`)
+
+// srtToVTT converts SubRip subtitles to WebVTT
+func srtToVTT(data []byte) []byte {
+	var out strings.Builder
+	out.WriteString("WEBVTT\n\n")
+
+	for _, block := range strings.Split(decodeSubtitleText(data), "\n\n") {
+		lines := strings.Split(strings.Trim(block, "\n"), "\n")
+		for i, line := range lines {
+			m := srtTiming.FindStringSubmatch(strings.TrimSpace(line))
+			if m == nil {
+				continue
+			}
+			fmt.Fprintf(&out, "%s:%s:%s.%s --> %s:%s:%s.%s\n",
+				pad2(m[1]), m[2], m[3], pad3(m[4]), pad2(m[5]), m[6], m[7], pad3(m[8]))
+			for _, text := range lines[i+1:] {
+				// A blank line would end the cue early in WebVTT
+				if strings.TrimSpace(text) != "" {
+					out.WriteString(strings.ReplaceAll(text, "-->", "->") + "\n")
+				}
+			}
+			out.WriteString("\n")
+			break
+		}
+	}
+	return []byte(out.String())
+}
+
+var assOverride = regexp.MustCompile(`\{[^}]*\}`)
+
+// assToVTT converts the dialogue events of an ASS/SSA script to WebVTT.
+// Styling and positioning are dropped; only timing and text are kept.
+func assToVTT(data []byte) []byte {
+	var out strings.Builder
+	out.WriteString("WEBVTT\n\n")
+
+	inEvents := false
+	fields := []string{"layer", "start", "end", "style", "name", "marginl", "marginr", "marginv", "effect", "text"}
+	for _, line := range strings.Split(decodeSubtitleText(data), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			inEvents = strings.EqualFold(line, "[Events]")
+			continue
+		}
+		if !inEvents {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "format":
+			fields = fields[:0]
+			for _, f := range strings.Split(value, ",") {
+				fields = append(fields, strings.ToLower(strings.TrimSpace(f)))
+			}
+		case "dialogue":
+			// Text is always the last field and may itself contain commas
+			parts := strings.SplitN(strings.TrimSpace(value), ",", len(fields))
+			if len(parts) != len(fields) {
+				continue
+			}
+			var start, end, text string
+			for i, f := range fields {
+				switch f {
+				case "start":
+					start = parts[i]
+				case "end":
+					end = parts[i]
+				case "text":
+					text = parts[i]
+				}
+			}
+			startTS, ok1 := assTimestamp(start)
+			endTS, ok2 := assTimestamp(end)
+			if !ok1 || !ok2 {
+				continue
+			}
+			text = assOverride.ReplaceAllString(text, "")
+			text = strings.NewReplacer(`\N`, "\n", `\n`, "\n", `\h`, " ", "-->", "->").Replace(text)
+			if strings.TrimSpace(text) == "" {
+				continue
+			}
+			fmt.Fprintf(&out, "%s --> %s\n%s\n\n", startTS, endTS, text)
+		}
+	}
+	return []byte(out.String())
+}
+
+// assTimestamp converts "H:MM:SS.cc" to "HH:MM:SS.mmm"
+func assTimestamp(ts string) (string, bool) {
+	parts := strings.Split(strings.TrimSpace(ts), ":")
+	if len(parts) != 3 {
+		return "", false
+	}
+	sec, frac, _ := strings.Cut(parts[2], ".")
+	if _, err := strconv.Atoi(parts[0]); err != nil {
+		return "", false
+	}
+	return fmt.Sprintf("%s:%s:%s.%s", pad2(parts[0]), parts[1], sec, pad3(frac+"0")), true
+}
+
+func pad2(s string) string {
+	for len(s) < 2 {
+		s = "0" + s
+	}
+	return s
+}
+
+// pad3 normalises a fractional second to exactly three digits
+func pad3(s string) string {
+	for len(s) < 3 {
+		s += "0"
+	}
+	return s[:3]
+}
+
+// subtitleToVTT converts a sidecar subtitle file to WebVTT based on its format
+func subtitleToVTT(format string, data []byte) []byte {
+	switch format {
+	case "srt":
+		return srtToVTT(data)
+	case "ass", "ssa":
+		return assToVTT(data)
+	default:
+		return []byte(decodeSubtitleText(data))
+	}
+}
+
+// extractEmbeddedSubtitle uses ffmpeg to pull a subtitle stream out of a
+// container into a cached WebVTT file. ffmpeg writes to a temporary file that
+// is renamed into place, so readers never see a partial one, and is killed if
+// ctx ends first.
+func extractEmbeddedSubtitle(ctx context.Context, videoPath string, stream int, outputPath string) error {
+	tmpPath := outputPath + ".tmp"
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-i", videoPath,
+		"-map", fmt.Sprintf("0:%d", stream),
+		"-f", "webvtt",
+		"-y",
+		tmpPath,
+	)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("ffmpeg error: %v, output: %s", err, string(output))
+	}
+	return os.Rename(tmpPath, outputPath)
+}
+
+// subtitleExtraction lets concurrent requests for the same embedded track
+// share one ffmpeg run
+type subtitleExtraction struct {
+	done chan struct{}
+	err  error
+}
+
+// cachedSubtitle makes sure cachePath holds the embedded track, extracting
+// it when missing or older than the video. Only one extraction runs per
+// file at a time; other callers wait for its result.
+func (s *VideoServer) cachedSubtitle(video models.VideoFile, stream int, cachePath string) error {
+	if info, err := os.Stat(cachePath); err == nil && !info.ModTime().Before(video.LastModified) {
+		return nil
+	}
+
+	s.subtitleMu.Lock()
+	if extraction, ok := s.subtitleExtractions[cachePath]; ok {
+		s.subtitleMu.Unlock()
+		<-extraction.done
+		return extraction.err
+	}
+	extraction := &subtitleExtraction{done: make(chan struct{})}
+	s.subtitleExtractions[cachePath] = extraction
+	s.subtitleMu.Unlock()
+
+	videoPath := filepath.Join(s.Config.VideoDir, video.Name)
+	extraction.err = extractEmbeddedSubtitle(s.Ctx, videoPath, stream, cachePath)
+
+	s.subtitleMu.Lock()
+	delete(s.subtitleExtractions, cachePath)
+	s.subtitleMu.Unlock()
+	close(extraction.done)
+
+	return extraction.err
+}
+
+func (s *VideoServer) handleSubtitle(w *Response, path string) {
+	// Path format: /subtitles/{videoID}/{trackID}.vtt
+	parts := strings.Split(strings.TrimPrefix(path, "/subtitles/"), "/")
+	if len(parts) != 2 || !strings.HasSuffix(parts[1], ".vtt") {
+		s.writeError(w, 404, "Not Found")
+		s.Metrics.IncrementErrors()
+		return
+	}
+
+	video, exists := s.VideoStore.GetVideo(parts[0])
+	if !exists {
+		s.writeError(w, 404, "Video Not Found")
+		s.Metrics.IncrementErrors()
+		return
+	}
+	video = s.probeVideo(video)
+
+	trackID := strings.TrimSuffix(parts[1], ".vtt")
+	var track *models.SubtitleTrack
+	for _, t := range video.AllSubtitles() {
+		if t.ID == trackID {
+			track = &t
+			break
+		}
+	}
+	if track == nil {
+		s.writeError(w, 404, "Subtitle Not Found")
+		s.Metrics.IncrementErrors()
+		return
+	}
+
+	var body []byte
+	if track.Path != "" {
+		data, err := os.ReadFile(track.Path)
+		if err != nil {
+			w.Conn.Log.Error("reading subtitle", "error", err, "path", track.Path)
+			s.writeError(w, 500, "Internal Server Error")
+			s.Metrics.IncrementErrors()
+			return
+		}
+		body = subtitleToVTT(track.Format, data)
+	} else {
+		cachePath := filepath.Join(s.Config.SubtitleDir, fmt.Sprintf("%s-%d.vtt", video.VideoID, track.Stream))
+		if err := s.cachedSubtitle(video, track.Stream, cachePath); err != nil {
+			w.Conn.Log.Error("extracting subtitle", "error", err, "video", video.Name, "stream", track.Stream)
+			s.writeError(w, 500, "Internal Server Error")
+			s.Metrics.IncrementErrors()
+			return
+		}
+
+		data, err := os.ReadFile(cachePath)
+		if err != nil {
+			s.writeError(w, 500, "Internal Server Error")
+			s.Metrics.IncrementErrors()
+			return
+		}
+		body = data
+	}
+
+	s.writeText(w, 200, "text/vtt; charset=utf-8", body)
+}
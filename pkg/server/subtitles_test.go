@@ -0,0 +1,298 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"ren.local/gocast/pkg/models"
+)
+
+// fakeFFmpeg puts an ffmpeg on PATH that records each run in a log file,
+// takes a moment, and writes a small WebVTT file to its last argument
+func fakeFFmpeg(t *testing.T) (runs func() int) {
+	t.Helper()
+	dir := t.TempDir()
+	runLog := filepath.Join(dir, "runs")
+	script := fmt.Sprintf("#!/bin/sh\necho run >> %q\nsleep 0.2\nfor out; do :; done\nprintf 'WEBVTT\\n\\n00:00:01.000 --> 00:00:02.000\\nHello\\n' > \"$out\"\n", runLog)
+	if err := os.WriteFile(filepath.Join(dir, "ffmpeg"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return func() int {
+		data, _ := os.ReadFile(runLog)
+		return strings.Count(string(data), "run")
+	}
+}
+
+func TestEmbeddedSubtitleExtractedOnce(t *testing.T) {
+	runs := fakeFFmpeg(t)
+	s := newTestServer(t, nil)
+	id, _ := addTestVideo(t, s, "subs.mkv", 1000)
+	video, _ := s.VideoStore.GetVideo(id)
+	video.Media = &models.MediaInfo{Subtitles: []models.SubtitleTrack{{ID: "e0", Format: "subrip", Stream: 2}}}
+	s.VideoStore.AddVideo(video)
+
+	url := fmt.Sprintf("http://%s/subtitles/%s/e0.vtt", s.addr(), id)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(url)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			data, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != 200 || !strings.Contains(string(data), "Hello") {
+				t.Errorf("status %d, body %q", resp.StatusCode, data)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := runs(); n != 1 {
+		t.Errorf("ffmpeg ran %d times, want once", n)
+	}
+	cachePath := filepath.Join(s.Config.SubtitleDir, id+"-2.vtt")
+	if _, err := os.Stat(cachePath); err != nil {
+		t.Errorf("extracted track not cached: %v", err)
+	}
+	if _, err := os.Stat(cachePath + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+
+	// Later requests are answered from the cache
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if n := runs(); resp.StatusCode != 200 || n != 1 {
+		t.Errorf("cached request: status %d, %d ffmpeg runs", resp.StatusCode, n)
+	}
+}
+
+func TestDecodeSubtitleText(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"UTF-8", "Café\n", "Café\n"},
+		{"byte order mark", "\xef\xbb\xbfCafé\n", "Café\n"},
+		{"Latin-1", "Caf\xe9 cr\xe8me \xbfque?\n", "Café crème ¿que?\n"},
+		{"Latin-1 after a byte order mark", "\xef\xbb\xbfCaf\xe9", "Café"},
+		{"CRLF", "one\r\ntwo\r\n", "one\ntwo\n"},
+		{"lone CR", "one\rtwo\r", "one\ntwo\n"},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		if got := decodeSubtitleText([]byte(tt.data)); got != tt.want {
+			t.Errorf("%s: decodeSubtitleText = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSRTToVTT(t *testing.T) {
+	tests := []struct {
+		name string
+		srt  string
+		want string
+	}{
+		{
+			name: "cues",
+			srt:  "1\n00:00:01,000 --> 00:00:02,500\nHello\nthere\n\n2\n00:00:03,000 --> 00:00:04,000\nBye\n",
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:02.500\nHello\nthere\n\n00:00:03.000 --> 00:00:04.000\nBye\n\n",
+		},
+		{
+			name: "CRLF and byte order mark",
+			srt:  "\xef\xbb\xbf1\r\n00:00:01,000 --> 00:00:02,000\r\nHello\r\n\r\n",
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nHello\n\n",
+		},
+		{
+			name: "Latin-1",
+			srt:  "1\n00:00:01,000 --> 00:00:02,000\nCaf\xe9\n",
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nCafé\n\n",
+		},
+		{
+			name: "loose timing",
+			srt:  "1\n0:00:01.5 --> 0:00:02,25 X1:0 X2:100\nHello\n",
+			want: "WEBVTT\n\n00:00:01.500 --> 00:00:02.250\nHello\n\n",
+		},
+		{
+			name: "no index and extra blank lines",
+			srt:  "\n\n00:00:01,000 --> 00:00:02,000\nHello\n\n\n\n3\n00:00:03,000 --> 00:00:04,000\nBye",
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nHello\n\n00:00:03.000 --> 00:00:04.000\nBye\n\n",
+		},
+		{
+			name: "whitespace line inside a cue",
+			srt:  "1\n00:00:01,000 --> 00:00:02,000\nHello\n \nthere\n",
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nHello\nthere\n\n",
+		},
+		{
+			name: "arrow in text",
+			srt:  "1\n00:00:01,000 --> 00:00:02,000\nA --> B\n",
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nA -> B\n\n",
+		},
+		{
+			name: "block without timing",
+			srt:  "1\nnot a timing\nHello\n\n2\n00:00:03,000 --> 00:00:04,000\nBye\n",
+			want: "WEBVTT\n\n00:00:03.000 --> 00:00:04.000\nBye\n\n",
+		},
+		{
+			name: "empty",
+			srt:  "",
+			want: "WEBVTT\n\n",
+		},
+	}
+	for _, tt := range tests {
+		if got := string(srtToVTT([]byte(tt.srt))); got != tt.want {
+			t.Errorf("%s: srtToVTT = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestASSToVTT(t *testing.T) {
+	const header = "[Script Info]\nTitle: Test\nScriptType: v4.00+\n\n[V4+ Styles]\nFormat: Name, Fontname\nStyle: Default,Arial\n\n"
+	tests := []struct {
+		name string
+		ass  string
+		want string
+	}{
+		{
+			name: "default fields",
+			ass: header + "[Events]\nFormat: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text\n" +
+				"Dialogue: 0,0:00:01.00,0:00:02.50,Default,,0,0,0,,Hello\n",
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:02.500\nHello\n\n",
+		},
+		{
+			name: "no Format line",
+			ass:  header + "[Events]\nDialogue: 0,0:00:01.00,0:00:02.00,Default,,0,0,0,,Hello\n",
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nHello\n\n",
+		},
+		{
+			name: "custom field order",
+			ass: header + "[Events]\nFormat: Start, End, Style, Text\n" +
+				"Dialogue: 1:02:03.45,1:02:04.00,Default,Hello\n",
+			want: "WEBVTT\n\n01:02:03.450 --> 01:02:04.000\nHello\n\n",
+		},
+		{
+			name: "end before start",
+			ass: header + "[Events]\nFormat: Style, End, Start, Text\n" +
+				"Dialogue: Default,0:00:02.00,0:00:01.00,Hello\n",
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nHello\n\n",
+		},
+		{
+			name: "commas in text",
+			ass: header + "[Events]\nFormat: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text\n" +
+				"Dialogue: 0,0:00:01.00,0:00:02.00,Default,,0,0,0,,Well, well, well.\n",
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nWell, well, well.\n\n",
+		},
+		{
+			name: "overrides, breaks and hard spaces",
+			ass: header + "[Events]\nFormat: Start, End, Text\n" +
+				`Dialogue: 0:00:01.00,0:00:02.00,{\i1}Hello{\i0}\Nthere\nyou\hall, A --> B` + "\n",
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nHello\nthere\nyou all, A -> B\n\n",
+		},
+		{
+			name: "comments, blank text and bad timing skipped",
+			ass: header + "[Events]\nFormat: Start, End, Text\n" +
+				"Comment: 0:00:01.00,0:00:02.00,Note\n" +
+				"Dialogue: 0:00:02.00,0:00:03.00,{\\pos(10,10)}\n" +
+				"Dialogue: soon,0:00:04.00,Bad\n" +
+				"Dialogue: 0:00:05.00,0:00:06.00\n" +
+				"Dialogue: 0:00:07.00,0:00:08.00,Good\n",
+			want: "WEBVTT\n\n00:00:07.000 --> 00:00:08.000\nGood\n\n",
+		},
+		{
+			name: "dialogue outside Events ignored",
+			ass:  "[Script Info]\nDialogue: 0,0:00:01.00,0:00:02.00,Default,,0,0,0,,Hello\n",
+			want: "WEBVTT\n\n",
+		},
+		{
+			name: "SSA with CRLF and Latin-1",
+			ass: "[Script Info]\r\nScriptType: v4.00\r\n\r\n[events]\r\n" +
+				"Format: Marked, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text\r\n" +
+				"Dialogue: Marked=0,0:00:01.00,0:00:02.00,Default,,0000,0000,0000,,Caf\xe9\r\n",
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nCafé\n\n",
+		},
+	}
+	for _, tt := range tests {
+		if got := string(assToVTT([]byte(tt.ass))); got != tt.want {
+			t.Errorf("%s: assToVTT = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFindSidecarSubtitles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"Movie.mkv",
+		"Movie.srt",
+		"Movie.en.srt",
+		"Movie.eng.forced.ass",
+		"Movie.English.sdh.srt",
+		"Movie.fr.default.vtt",
+		"Movie.Commentary.en.srt",
+		"Movie.xx.ssa",
+		"Movie.en.txt",     // Not a subtitle format
+		"Movie 2.en.srt",   // Another video's
+		"Movies.en.srt",    // Another video's
+		"movie.en.srt",     // Names are case-sensitive
+		"Movie.srt.bak",    // Not a subtitle format
+		"Other.mkv.en.srt", // Another video's
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "Movie.de.srt"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	track := func(id, name, label, language string, isDefault, forced bool) models.SubtitleTrack {
+		return models.SubtitleTrack{
+			ID:       id,
+			Label:    label,
+			Language: language,
+			Format:   strings.TrimPrefix(filepath.Ext(name), "."),
+			Path:     filepath.Join(dir, name),
+			Default:  isDefault,
+			Forced:   forced,
+		}
+	}
+	want := []models.SubtitleTrack{
+		track("s0", "Movie.Commentary.en.srt", "English (Commentary)", "en", false, false),
+		track("s1", "Movie.English.sdh.srt", "English (SDH)", "en", false, false),
+		track("s2", "Movie.en.srt", "English", "en", false, false),
+		track("s3", "Movie.eng.forced.ass", "English [Forced]", "eng", false, true),
+		track("s4", "Movie.fr.default.vtt", "French", "fr", true, false),
+		track("s5", "Movie.srt", "Unknown", "", false, false),
+		track("s6", "Movie.xx.ssa", "xx", "", false, false),
+	}
+
+	cache := make(map[string][]os.DirEntry)
+	got := findSidecarSubtitles(filepath.Join(dir, "Movie.mkv"), cache)
+	if len(got) != len(want) {
+		t.Fatalf("found %d tracks, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("track %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	// The directory is read once and then served from the cache
+	os.Remove(filepath.Join(dir, "Movie.srt"))
+	if again := findSidecarSubtitles(filepath.Join(dir, "Movie.mkv"), cache); len(again) != len(want) {
+		t.Errorf("second lookup found %d tracks, want %d from the cache", len(again), len(want))
+	}
+}
@@ -0,0 +1,531 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	"math"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"ren.local/gocast/pkg/models"
+	"ren.local/gocast/pkg/templates"
+)
+
+// posterSuffixes are sidecar image names checked next to a video, in order
+var posterSuffixes = []string{
+	".poster.jpg", ".poster.png",
+	"-poster.jpg", "-poster.png",
+	".jpg", ".png",
+}
+
+// thumbnailPath is the cached thumbnail served for a video
+func (s *VideoServer) thumbnailPath(videoID string) string {
+	return filepath.Join(s.Config.ThumbnailDir, videoID+".jpg")
+}
+
+// Overrides set through POST /thumbnails/{id}
+func (s *VideoServer) uploadedPosterPath(videoID string) string {
+	return filepath.Join(s.Config.ThumbnailDir, videoID+".poster")
+}
+
+func (s *VideoServer) customTimestampPath(videoID string) string {
+	return filepath.Join(s.Config.ThumbnailDir, videoID+".timestamp")
+}
+
+// sidecarPoster returns a poster image stored next to the video, if any
+func (s *VideoServer) sidecarPoster(video models.VideoFile) string {
+	base := strings.TrimSuffix(filepath.Join(s.Config.VideoDir, video.Name), filepath.Ext(video.Name))
+	for _, suffix := range posterSuffixes {
+		if _, err := os.Stat(base + suffix); err == nil {
+			return base + suffix
+		}
+	}
+	return ""
+}
+
+// thumbnailStale reports whether the cached thumbnail is missing or older
+// than the video or any of its overrides
+func (s *VideoServer) thumbnailStale(video models.VideoFile) bool {
+	info, err := os.Stat(s.thumbnailPath(video.VideoID))
+	if err != nil {
+		return true
+	}
+
+	sources := []string{
+		s.uploadedPosterPath(video.VideoID),
+		s.customTimestampPath(video.VideoID),
+		s.sidecarPoster(video),
+	}
+	for _, source := range sources {
+		if source == "" {
+			continue
+		}
+		if sourceInfo, err := os.Stat(source); err == nil && sourceInfo.ModTime().After(info.ModTime()) {
+			return true
+		}
+	}
+	return info.ModTime().Before(video.LastModified)
+}
+
+// thumbnailFormats describes the image formats thumbnails can be served in
+var thumbnailFormats = map[string]struct {
+	MimeType  string
+	Extension string
+	Encoder   string
+}{
+	"jpeg": {"image/jpeg", "jpg", "mjpeg"},
+	"webp": {"image/webp", "webp", "libwebp"},
+	"avif": {"image/avif", "avif", "libaom-av1"},
+}
+
+// ffmpegEncoders caches the output of `ffmpeg -encoders`
+var ffmpegEncoders struct {
+	once sync.Once
+	list string
+}
+
+// encoderAvailable reports whether the local ffmpeg build has an encoder
+func (s *VideoServer) encoderAvailable(name string) bool {
+	ffmpegEncoders.once.Do(func() {
+		output, err := exec.CommandContext(s.Ctx, "ffmpeg", "-hide_banner", "-encoders").Output()
+		if err != nil {
+			s.Logger.Warn("listing ffmpeg encoders", "error", err)
+		}
+		ffmpegEncoders.list = string(output)
+	})
+	return strings.Contains(ffmpegEncoders.list, " "+name+" ")
+}
+
+// variantPath is where a resized and re-encoded copy of the thumbnail lives
+func (s *VideoServer) variantPath(videoID string, width int, format string) string {
+	return filepath.Join(s.Config.ThumbnailDir, videoID, fmt.Sprintf("%d.%s", width, thumbnailFormats[format].Extension))
+}
+
+// masterWidth is the resolution the source frame is captured at; every
+// variant is scaled down from it
+func (s *VideoServer) masterWidth() int {
+	width := s.Config.ThumbnailWidth
+	for _, w := range s.Config.ThumbnailWidths {
+		width = max(width, w)
+	}
+	return width
+}
+
+// generateThumbnail is the single thumbnail pipeline. It captures the master
+// image and then derives the JPEG variants; WebP and AVIF variants are
+// encoded the first time a client asks for them.
+func (s *VideoServer) generateThumbnail(video models.VideoFile) error {
+	// Write beside the final name so clients never read a partial file
+	outputPath := s.thumbnailPath(video.VideoID)
+	tmpPath := outputPath + ".tmp"
+	if err := s.generateMasterThumbnail(video, tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, outputPath); err != nil {
+		return err
+	}
+
+	os.RemoveAll(filepath.Join(s.Config.ThumbnailDir, video.VideoID))
+	for _, width := range s.Config.ThumbnailWidths {
+		if err := s.encodeVariant(video.VideoID, width, "jpeg"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// generateMasterThumbnail picks the source image. It uses, in order of
+// preference: an uploaded poster, a sidecar poster image, a user-chosen
+// timestamp, and finally the best scoring of several sampled frames. The
+// image is written to outputPath.
+func (s *VideoServer) generateMasterThumbnail(video models.VideoFile, outputPath string) error {
+	videoPath := filepath.Join(s.Config.VideoDir, video.Name)
+	width := s.masterWidth()
+
+	// An override that cannot be used is dropped so automatic selection
+	// resumes
+	if poster := s.uploadedPosterPath(video.VideoID); fileExists(poster) {
+		err := s.extractFrame(poster, -1, outputPath, width)
+		if err == nil {
+			return nil
+		}
+		s.Logger.Warn("uploaded poster unusable, removing it", "error", err, "video", video.Name)
+		os.Remove(poster)
+	}
+	if poster := s.sidecarPoster(video); poster != "" {
+		return s.extractFrame(poster, -1, outputPath, width)
+	}
+	timestampPath := s.customTimestampPath(video.VideoID)
+	if data, err := os.ReadFile(timestampPath); err == nil {
+		seconds, err := strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+		if err == nil {
+			err = s.extractFrame(videoPath, seconds, outputPath, width)
+		}
+		if err == nil {
+			return nil
+		}
+		s.Logger.Warn("custom thumbnail timestamp unusable, removing it", "error", err, "video", video.Name)
+		os.Remove(timestampPath)
+	}
+
+	video = s.probeVideo(video)
+	candidates := s.Config.ThumbnailCandidates
+	if video.Media.Duration <= 0 || candidates < 2 {
+		return s.extractFrame(videoPath, math.Min(1, video.Media.Duration/2), outputPath, width)
+	}
+
+	// Sample evenly between 10% and 90% to skip intros and credits. Scoring
+	// happens on small frames; only the winner is captured at full size.
+	bestAt, bestScore := -1.0, -1.0
+	for i := 0; i < candidates; i++ {
+		at := video.Media.Duration * (0.1 + 0.8*float64(i)/float64(candidates-1))
+		candidate := fmt.Sprintf("%s.candidate%d.jpg", outputPath, i)
+		defer os.Remove(candidate)
+
+		if err := s.extractFrame(videoPath, at, candidate, s.Config.ThumbnailWidth); err != nil {
+			s.Logger.Warn("sampling thumbnail frame", "error", err, "video", video.Name, "seconds", at)
+			continue
+		}
+		score, err := scoreFrame(candidate)
+		if err != nil {
+			continue
+		}
+		if score > bestScore {
+			bestAt, bestScore = at, score
+		}
+	}
+
+	if bestAt < 0 {
+		return fmt.Errorf("no usable frames in %s", video.Name)
+	}
+	return s.extractFrame(videoPath, bestAt, outputPath, width)
+}
+
+// extractFrame writes one JPEG frame no wider than width. A negative
+// timestamp means the input is a still image rather than a video.
+func (s *VideoServer) extractFrame(inputPath string, seconds float64, outputPath string, width int) error {
+	args := []string{}
+	if seconds >= 0 {
+		// Seeking before -i is fast and lands on the nearest keyframe
+		args = append(args, "-ss", strconv.FormatFloat(seconds, 'f', 3, 64))
+	}
+	args = append(args,
+		"-i", inputPath,
+		"-frames:v", "1",
+		"-vf", fmt.Sprintf("scale='min(%d,iw)':-2", width), // Scale width, maintain aspect ratio
+		"-q:v", strconv.Itoa(jpegQScale(s.Config.ThumbnailQuality)),
+		"-f", "image2",
+		"-y",
+		outputPath,
+	)
+
+	cmd := exec.CommandContext(s.Ctx, "ffmpeg", args...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ffmpeg error: %v, output: %s", err, string(output))
+	}
+	return nil
+}
+
+// encodeVariant scales the master thumbnail to width and encodes it in format
+func (s *VideoServer) encodeVariant(videoID string, width int, format string) error {
+	outputPath := s.variantPath(videoID, width, format)
+	if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+		return err
+	}
+
+	quality := s.Config.ThumbnailQuality
+	args := []string{
+		"-i", s.thumbnailPath(videoID),
+		"-vf", fmt.Sprintf("scale='min(%d,iw)':-2", width),
+	}
+	switch format {
+	case "webp":
+		args = append(args, "-c:v", "libwebp", "-quality", strconv.Itoa(quality), "-f", "webp")
+	case "avif":
+		// Map quality onto a CRF between 20 (best) and 50
+		args = append(args, "-c:v", "libaom-av1", "-still-picture", "1",
+			"-crf", strconv.Itoa(20+(100-quality)*30/100), "-f", "avif")
+	default:
+		args = append(args, "-q:v", strconv.Itoa(jpegQScale(quality)), "-f", "image2")
+	}
+
+	// Write beside the final name so clients never read a partial file
+	tmpPath := outputPath + ".tmp"
+	args = append(args, "-y", tmpPath)
+	output, err := exec.CommandContext(s.Ctx, "ffmpeg", args...).CombinedOutput()
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("ffmpeg error: %v, output: %s", err, string(output))
+	}
+	return os.Rename(tmpPath, outputPath)
+}
+
+// thumbnailWidth picks the smallest configured width that satisfies a ?w=
+// request, falling back to ThumbnailWidth
+func (s *VideoServer) thumbnailWidth(requested string) int {
+	if len(s.Config.ThumbnailWidths) == 0 {
+		return s.Config.ThumbnailWidth
+	}
+	want, err := strconv.Atoi(requested)
+	if err != nil || want <= 0 {
+		want = s.Config.ThumbnailWidth
+	}
+
+	widths := append([]int{}, s.Config.ThumbnailWidths...)
+	sort.Ints(widths)
+	for _, width := range widths {
+		if width >= want {
+			return width
+		}
+	}
+	return widths[len(widths)-1]
+}
+
+// negotiateFormat returns the first configured format the client accepts
+// and ffmpeg can encode. JPEG is always available as a fallback.
+func (s *VideoServer) negotiateFormat(accept string) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.ReplaceAll(strings.TrimSpace(params), " ", "") != "q=0" {
+			accepted[strings.ToLower(strings.TrimSpace(mediaType))] = true
+		}
+	}
+
+	for _, format := range s.Config.ThumbnailFormats {
+		info, ok := thumbnailFormats[format]
+		if ok && accepted[info.MimeType] && s.encoderAvailable(info.Encoder) {
+			return format
+		}
+	}
+	return "jpeg"
+}
+
+// jpegQScale maps a 1-100 quality percentage onto ffmpeg's 2-31 qscale,
+// where lower is better
+func jpegQScale(quality int) int {
+	if quality < 1 {
+		quality = 1
+	} else if quality > 100 {
+		quality = 100
+	}
+	return 2 + (100-quality)*29/100
+}
+
+// scoreFrame rates how representative a frame is. Frames with more detail
+// (higher luminance entropy) win; near-black or near-white frames such as
+// fades and title cards are heavily penalised.
+func scoreFrame(path string) (float64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return 0, err
+	}
+
+	var histogram [256]int
+	var total, sum int
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += 2 {
+		for x := bounds.Min.X; x < bounds.Max.X; x += 2 {
+			r, g, b, _ := img.At(x, y).RGBA()
+			luma := (299*r + 587*g + 114*b) / 1000 >> 8
+			histogram[luma]++
+			sum += int(luma)
+			total++
+		}
+	}
+	if total == 0 {
+		return 0, fmt.Errorf("empty image")
+	}
+
+	entropy := 0.0
+	for _, count := range histogram {
+		if count > 0 {
+			p := float64(count) / float64(total)
+			entropy -= p * math.Log2(p)
+		}
+	}
+
+	mean := sum / total
+	if mean < 24 || mean > 232 {
+		entropy *= 0.1
+	}
+	return entropy, nil
+}
+
+// queueThumbnail schedules thumbnail generation on the background workers
+func (s *VideoServer) queueThumbnail(video models.VideoFile, priority int) {
+	s.Jobs.Enqueue("thumbnail:"+video.VideoID, priority, func() error {
+		return s.generateThumbnail(video)
+	})
+}
+
+// servePlaceholder answers thumbnail requests while generation is pending
+func (s *VideoServer) servePlaceholder(w *Response) {
+	data, err := templates.GetTemplatesFS().ReadFile("templates/placeholder.svg")
+	if err != nil {
+		s.writeError(w, 500, "Internal Server Error")
+		s.Metrics.IncrementErrors()
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	s.writeText(w, 200, "image/svg+xml", data)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func (s *VideoServer) handleThumbnail(w *Response, ip, path string, query url.Values, headers map[string]string) {
+	videoID := filepath.Base(path)
+	video, exists := s.VideoStore.GetVideo(videoID)
+	if !exists {
+		s.writeError(w, 404, "Video Not Found")
+		s.Metrics.IncrementErrors()
+		return
+	}
+
+	// Visible thumbnails jump ahead of the library scan's backlog. An
+	// outdated thumbnail is still served while its replacement is made.
+	masterPath := s.thumbnailPath(videoID)
+	if s.thumbnailStale(video) {
+		s.queueThumbnail(video, PriorityHigh)
+		if !fileExists(masterPath) {
+			s.servePlaceholder(w)
+			return
+		}
+	}
+
+	// Serve the requested size and format if it has been encoded, otherwise
+	// queue it and fall back to JPEG at that size, then to the master image
+	width := s.thumbnailWidth(query.Get("w"))
+	format := s.negotiateFormat(headers["Accept"])
+	thumbnailPath, contentType := masterPath, "image/jpeg"
+	for _, candidate := range []string{format, "jpeg"} {
+		variant := s.variantPath(videoID, width, candidate)
+		if fileExists(variant) {
+			thumbnailPath, contentType = variant, thumbnailFormats[candidate].MimeType
+			break
+		}
+		key := fmt.Sprintf("thumbnail:%s:%d:%s", videoID, width, candidate)
+		s.Jobs.Enqueue(key, PriorityHigh, func() error {
+			return s.encodeVariant(videoID, width, candidate)
+		})
+	}
+
+	thumbnailFile, err := os.Open(thumbnailPath)
+	if err != nil {
+		s.writeError(w, 500, "Internal Server Error")
+		s.Metrics.IncrementErrors()
+		return
+	}
+	defer thumbnailFile.Close()
+
+	thumbnailFileInfo, err := thumbnailFile.Stat()
+	if err != nil {
+		s.writeError(w, 500, "Internal Server Error")
+		s.Metrics.IncrementErrors()
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(thumbnailFileInfo.Size(), 10))
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Vary", "Accept")
+	w.WriteHeader(200)
+
+	release := s.Shaper.AttachRoute(w.Conn, ip, RouteThumbnail, videoID, 0)
+	defer release()
+
+	// Start streaming
+	s.streamVideo(w, thumbnailFile, 0, thumbnailFileInfo.Size()-1)
+}
+
+// updateThumbnail handles thumbnail overrides:
+//
+//	POST /thumbnails/{id}?t=93.5   use the frame at a custom timestamp
+//	POST /thumbnails/{id}          body is an uploaded poster image
+//	DELETE /thumbnails/{id}        go back to automatic selection
+//
+// Like the admin routes they are limited to AdminNetworks. The thumbnail is
+// rebuilt on the job queue, so the response is 202 Accepted.
+func (s *VideoServer) updateThumbnail(w *Response, ip, method, path string, query url.Values, headers map[string]string, body *bufio.Reader) {
+	if !s.isAdmin(w.Conn.Conn, ip, headers) || !s.sameOrigin(w.Conn.Conn, headers) {
+		s.writeError(w, 403, "Forbidden")
+		s.Metrics.IncrementErrors()
+		return
+	}
+
+	videoID := filepath.Base(path)
+	video, exists := s.VideoStore.GetVideo(videoID)
+	if !exists {
+		s.writeError(w, 404, "Video Not Found")
+		s.Metrics.IncrementErrors()
+		return
+	}
+
+	posterPath := s.uploadedPosterPath(videoID)
+	timestampPath := s.customTimestampPath(videoID)
+
+	switch {
+	case method == "DELETE":
+		// Removing the overrides leaves nothing newer than the thumbnail,
+		// so drop it too for thumbnailStale to notice
+		os.Remove(posterPath)
+		os.Remove(timestampPath)
+		os.Remove(s.thumbnailPath(videoID))
+	case query.Has("t"):
+		seconds, err := strconv.ParseFloat(query.Get("t"), 64)
+		if err != nil || seconds < 0 {
+			s.writeError(w, 400, "Bad Request")
+			s.Metrics.IncrementErrors()
+			return
+		}
+		os.Remove(posterPath)
+		if err := os.WriteFile(timestampPath, []byte(strconv.FormatFloat(seconds, 'f', 3, 64)), 0644); err != nil {
+			s.writeError(w, 500, "Internal Server Error")
+			s.Metrics.IncrementErrors()
+			return
+		}
+	default:
+		if !strings.HasPrefix(headers["Content-Type"], "image/") {
+			s.writeError(w, 415, "Unsupported Media Type")
+			s.Metrics.IncrementErrors()
+			return
+		}
+		data, ok := s.readBody(w, headers, body, s.Config.MaxPosterSize)
+		if !ok {
+			return
+		}
+		os.Remove(timestampPath)
+		if err := os.WriteFile(posterPath, data, 0644); err != nil {
+			s.writeError(w, 500, "Internal Server Error")
+			s.Metrics.IncrementErrors()
+			return
+		}
+	}
+
+	// A job already running for this video may have read the old override;
+	// the override is then newer than its output and the next request for
+	// the thumbnail queues it again
+	s.queueThumbnail(video, PriorityHigh)
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(202)
+}
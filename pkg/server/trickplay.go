@@ -0,0 +1,134 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"ren.local/gocast/pkg/models"
+)
+
+var spriteName = regexp.MustCompile(`^sprite-\d{3}\.jpg$`)
+
+// trickplayDir is where the sprite sheets and index for a video are cached
+func (s *VideoServer) trickplayDir(videoID string) string {
+	return filepath.Join(s.Config.ThumbnailDir, "trickplay", videoID)
+}
+
+// ensureTrickplay queues sprite generation for a video unless it is already
+// cached and up to date. It decodes the whole file, so it waits behind the
+// thumbnails and variants that pages are blocked on.
+func (s *VideoServer) ensureTrickplay(video models.VideoFile) {
+	indexPath := filepath.Join(s.trickplayDir(video.VideoID), "index.vtt")
+	if info, err := os.Stat(indexPath); err == nil && !info.ModTime().Before(video.LastModified) {
+		return
+	}
+	s.Jobs.Enqueue("trickplay:"+video.VideoID, PriorityLow, func() error {
+		return s.generateTrickplay(video)
+	})
+}
+
+// generateTrickplay extracts a frame every TrickplayInterval seconds, tiles
+// them into sprite sheets and writes a WebVTT index mapping time ranges to
+// regions of those sheets
+func (s *VideoServer) generateTrickplay(video models.VideoFile) error {
+	video = s.probeVideo(video)
+	if video.Media.Duration <= 0 {
+		return fmt.Errorf("unknown duration")
+	}
+
+	interval := s.Config.TrickplayInterval.Seconds()
+	cols, rows := s.Config.TrickplayColumns, s.Config.TrickplayRows
+	width := s.Config.TrickplayWidth
+	height := width * 9 / 16
+	if video.Media.Width > 0 && video.Media.Height > 0 {
+		height = width * video.Media.Height / video.Media.Width
+	}
+	height += height % 2 // Encoders prefer even dimensions
+
+	// Build into a temporary directory so readers never see a partial set
+	finalDir := s.trickplayDir(video.VideoID)
+	tmpDir := finalDir + ".tmp"
+	os.RemoveAll(tmpDir)
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cmd := exec.CommandContext(s.Ctx, "ffmpeg",
+		"-i", filepath.Join(s.Config.VideoDir, video.Name),
+		"-an", "-sn",
+		"-vf", fmt.Sprintf("fps=1/%g,scale=%d:%d,tile=%dx%d", interval, width, height, cols, rows),
+		"-q:v", "5",
+		"-y",
+		filepath.Join(tmpDir, "sprite-%03d.jpg"),
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("ffmpeg error: %v, output: %s", err, string(output))
+	}
+
+	var index strings.Builder
+	index.WriteString("WEBVTT\n\n")
+	frames := int(math.Ceil(video.Media.Duration / interval))
+	perSheet := cols * rows
+	for i := 0; i < frames; i++ {
+		start := float64(i) * interval
+		end := math.Min(start+interval, video.Media.Duration)
+		pos := i % perSheet
+		// Paths are relative to /trickplay/{id}.vtt
+		fmt.Fprintf(&index, "%s --> %s\n%s/sprite-%03d.jpg#xywh=%d,%d,%d,%d\n\n",
+			vttTimestamp(start), vttTimestamp(end), video.VideoID, i/perSheet+1,
+			(pos%cols)*width, (pos/cols)*height, width, height)
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, "index.vtt"), []byte(index.String()), 0644); err != nil {
+		return err
+	}
+
+	os.RemoveAll(finalDir)
+	return os.Rename(tmpDir, finalDir)
+}
+
+// vttTimestamp formats seconds as HH:MM:SS.mmm
+func vttTimestamp(seconds float64) string {
+	ms := int64(math.Round(seconds * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+func (s *VideoServer) handleTrickplay(w *Response, path string) {
+	// Path format: /trickplay/{videoID}.vtt or /trickplay/{videoID}/sprite-NNN.jpg
+	rest := strings.TrimPrefix(path, "/trickplay/")
+	videoID, sprite, isSprite := strings.Cut(rest, "/")
+	if !isSprite {
+		videoID = strings.TrimSuffix(rest, ".vtt")
+	}
+
+	video, exists := s.VideoStore.GetVideo(videoID)
+	if !exists || (isSprite && !spriteName.MatchString(sprite)) || (!isSprite && !strings.HasSuffix(rest, ".vtt")) {
+		s.writeError(w, 404, "Not Found")
+		s.Metrics.IncrementErrors()
+		return
+	}
+
+	filePath := filepath.Join(s.trickplayDir(videoID), "index.vtt")
+	contentType := "text/vtt; charset=utf-8"
+	if isSprite {
+		filePath = filepath.Join(s.trickplayDir(videoID), sprite)
+		contentType = "image/jpeg"
+	}
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		// Not generated yet; kick off generation and let the player retry
+		s.ensureTrickplay(video)
+		w.Header().Set("Retry-After", "30")
+		s.writeText(w, 503, "text/plain; charset=utf-8", []byte("Trickplay Not Ready"))
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	s.writeText(w, 200, contentType, data)
+}
@@ -5,7 +5,15 @@ import "embed"
 //go:embed templates/*
 var templatesFS embed.FS
 
+//go:embed static/*
+var staticFS embed.FS
+
 // GetTemplatesFS returns the embedded templates filesystem
 func GetTemplatesFS() embed.FS {
 	return templatesFS
 }
+
+// GetStaticFS returns the embedded CSS and JavaScript served under /static/
+func GetStaticFS() embed.FS {
+	return staticFS
+}